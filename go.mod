@@ -4,7 +4,11 @@ go 1.24.0
 
 require (
 	github.com/PlakarKorp/kloset v1.1.0-beta.1
+	github.com/andybalholm/brotli v1.2.5
 	github.com/google/uuid v1.6.0
+	github.com/zeebo/blake3 v0.2.4
+	golang.org/x/mod v0.32.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -25,10 +29,9 @@ require (
 	github.com/tink-crypto/tink-go/v2 v2.6.0 // indirect
 	github.com/vmihailenco/msgpack/v5 v5.4.1 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
-	github.com/zeebo/blake3 v0.2.4 // indirect
 	golang.org/x/crypto v0.47.0 // indirect
 	golang.org/x/exp v0.0.0-20250819193227-8b4c13bb791b // indirect
-	golang.org/x/mod v0.32.0 // indirect
 	golang.org/x/sys v0.40.0 // indirect
 	google.golang.org/protobuf v1.36.10 // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// versionsPath is where a server lists the API versions it serves, each
+// under its own path prefix such as /v2.
+const versionsPath = "/versions"
+
+func parseAPIVersions(storeConfig map[string]string) ([]string, error) {
+	value, ok := storeConfig["api_versions"]
+	if !ok {
+		return nil, nil
+	}
+
+	var ret []string
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !semver.IsValid(v) {
+			return nil, fmt.Errorf("invalid api_versions entry %q: expected a version such as v2", v)
+		}
+		ret = append(ret, v)
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("api_versions is empty")
+	}
+	return ret, nil
+}
+
+// negotiateAPIVersion picks the highest version both sides speak and
+// has every following request go under its prefix.  A server that
+// doesn't list its versions is talked to without a prefix.
+func (s *Store) negotiateAPIVersion(ctx context.Context) error {
+	s.apiPrefix.Store(nil)
+
+	advertised, err := doRequest[[]string](ctx, s, &request{method: "GET", path: versionsPath, retry: &s.openRetry})
+	if se, ok := err.(*statusErr); ok && isUnsupported(se.status) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", versionsPath, err)
+	}
+	if len(advertised) == 0 {
+		return nil
+	}
+
+	best := ""
+	for _, v := range advertised {
+		for _, ours := range s.apiVersions {
+			if semver.Compare(v, ours) == 0 && (best == "" || semver.Compare(v, best) > 0) {
+				best = v
+			}
+		}
+	}
+	if best == "" {
+		return fmt.Errorf("server speaks API versions %s, none of %s",
+			strings.Join(advertised, ", "), strings.Join(s.apiVersions, ", "))
+	}
+
+	prefix := "/" + best
+	s.apiPrefix.Store(&prefix)
+	return nil
+}
+
+func (s *Store) apiPath() string {
+	if p := s.apiPrefix.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+)
+
+// versionedServer lists versions under /versions, 404 if nil, and logs
+// the paths of the other requests.
+func versionedServer(versions []string, paths *[]string, mu *sync.Mutex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == versionsPath {
+			if versions == nil {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(versions)
+			return
+		}
+		mu.Lock()
+		*paths = append(*paths, r.URL.Path)
+		mu.Unlock()
+		w.Write([]byte("[]"))
+	}
+}
+
+func TestAPIVersionNegotiation(t *testing.T) {
+	for _, test := range []struct {
+		advertised []string
+		prefix     string
+	}{
+		{[]string{"v1", "v2", "v3"}, "/v2"},
+		{[]string{"v2", "v1"}, "/v2"},
+		{[]string{"v1"}, "/v1"},
+		{[]string{}, ""},
+		{nil, ""},
+	} {
+		var mu sync.Mutex
+		var paths []string
+		s, _ := newTestStore(t, versionedServer(test.advertised, &paths, &mu), map[string]string{"api_versions": "v1, v2"})
+
+		if _, err := s.Open(context.Background()); err != nil {
+			t.Fatalf("%q: %v", test.advertised, err)
+		}
+		if _, err := s.List(context.Background(), storage.StorageResourceState); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		// Open goes to the root of the location, "/v2" then
+		root := test.prefix
+		if root == "" {
+			root = "/"
+		}
+		want := []string{root, test.prefix + "/resources/states"}
+		if len(paths) != 2 || paths[0] != want[0] || paths[1] != want[1] {
+			t.Errorf("server lists %q: requests went to %q, want %q", test.advertised, paths, want)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestAPIVersionNoneShared(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	s, _ := newTestStore(t, versionedServer([]string{"v3", "v4"}, &paths, &mu), map[string]string{"api_versions": "v1,v2"})
+
+	_, err := s.Open(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "none of v1, v2") {
+		t.Errorf("got %v, want the version mismatch reported", err)
+	}
+}
+
+func TestAPIVersionsInvalid(t *testing.T) {
+	for _, value := range []string{"", " , ", "2", "v1,latest"} {
+		if err := ValidateConfig(map[string]string{"location": "http://example.com", "api_versions": value}); err == nil {
+			t.Errorf("api_versions=%q accepted", value)
+		}
+	}
+}
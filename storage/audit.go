@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// AuditEntry records a mutating operation, never its payload.
+type AuditEntry struct {
+	Time      time.Time
+	Operation string // "put", "patch" or "delete"
+	Resource  storage.StorageResource
+	MAC       objects.MAC
+	Size      int64 // bytes sent, -1 when not applicable
+	Err       error
+}
+
+// SetAuditHook installs fn to be called once every mutating operation
+// completes, whether it succeeded or not.  fn is called synchronously
+// so it should not block.
+func (s *Store) SetAuditHook(fn func(AuditEntry)) {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	s.auditHook = fn
+}
+
+func (s *Store) audit(op string, res storage.StorageResource, mac objects.MAC, size int64, err error) {
+	s.tx.noteWrite(err)
+
+	s.auditMu.Lock()
+	fn := s.auditHook
+	s.auditMu.Unlock()
+	if fn == nil {
+		return
+	}
+
+	fn(AuditEntry{
+		Time:      s.clock.Now(),
+		Operation: op,
+		Resource:  res,
+		MAC:       mac,
+		Size:      size,
+		Err:       err,
+	})
+}
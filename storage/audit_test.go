@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestAuditHook(t *testing.T) {
+	clk := newFakeClock()
+	s, _ := newTestStoreClock(t, &memServer{}, nil, clk)
+	var entries []AuditEntry
+	s.SetAuditHook(func(e AuditEntry) { entries = append(entries, e) })
+	ctx := context.Background()
+
+	type want struct {
+		op   string
+		res  storage.StorageResource
+		mac  objects.MAC
+		size int64
+		err  bool
+	}
+	var wants []want
+	for _, res := range []storage.StorageResource{storage.StorageResourceState, storage.StorageResourcePackfile, storage.StorageResourceLock} {
+		if _, err := s.Put(ctx, res, objects.MAC{1}, bytes.NewReader([]byte("payload"))); err != nil {
+			t.Fatal(err)
+		}
+		rd, err := s.Get(ctx, res, objects.MAC{1}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rd.Close()
+		if err := s.Delete(ctx, res, objects.MAC{1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete(ctx, res, objects.MAC{2}); err == nil {
+			t.Fatal("delete of a missing object succeeded")
+		}
+		wants = append(wants,
+			want{"put", res, objects.MAC{1}, 7, false},
+			want{"delete", res, objects.MAC{1}, -1, false},
+			want{"delete", res, objects.MAC{2}, -1, true})
+	}
+
+	if len(entries) != len(wants) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(wants))
+	}
+	for i, e := range entries {
+		w := wants[i]
+		if e.Operation != w.op || e.Resource != w.res || e.MAC != w.mac || e.Size != w.size || (e.Err != nil) != w.err || !e.Time.Equal(clk.Now()) {
+			t.Errorf("entry %d is %+v, want %+v", i, e, w)
+		}
+		if bytes.Contains([]byte(fmt.Sprintf("%+v", e)), []byte("payload")) {
+			t.Errorf("entry %d carries the payload", i)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenges splits WWW-Authenticate values into their challenges,
+// a single value may hold several of them.
+func parseChallenges(values []string) []challenge {
+	var ret []challenge
+	for _, v := range values {
+		var cur *challenge
+		for _, part := range splitQuoted(v, ',') {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			// "Scheme k=v" starts a new challenge, "k=v" adds to it
+			scheme, rest, _ := strings.Cut(part, " ")
+			if !strings.Contains(scheme, "=") {
+				ret = append(ret, challenge{scheme: strings.ToLower(scheme), params: map[string]string{}})
+				cur = &ret[len(ret)-1]
+				part = strings.TrimSpace(rest)
+				if part == "" {
+					continue
+				}
+			}
+			if cur == nil {
+				continue
+			}
+			k, v, _ := strings.Cut(part, "=")
+			cur.params[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), `"`)
+		}
+	}
+	return ret
+}
+
+// splitQuoted splits s on sep, except within double quotes.
+func splitQuoted(s string, sep rune) []string {
+	var ret []string
+	quoted := false
+	start := 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			ret = append(ret, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(ret, s[start:])
+}
+
+// answerChallenge returns the Authorization header answering the first
+// challenge the store has credentials for, "" if there is none.
+func (s *Store) answerChallenge(r *http.Response) string {
+	for _, c := range parseChallenges(r.Header.Values("WWW-Authenticate")) {
+		switch c.scheme {
+		case "bearer":
+			// already sent up front, no use sending it again
+			auth := "Bearer " + s.authToken
+			if s.authToken != "" && r.Request.Header.Get("Authorization") != auth {
+				return auth
+			}
+		case "basic":
+			if s.username != "" {
+				creds := base64.StdEncoding.EncodeToString([]byte(s.username + ":" + s.password))
+				return "Basic " + creds
+			}
+		case "digest":
+			if s.username != "" {
+				if auth, err := s.digestAuth(r.Request, c.params); err == nil {
+					return auth
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// digestAuth computes the answer to a Digest challenge, see RFC 7616.
+func (s *Store) digestAuth(req *http.Request, params map[string]string) (string, error) {
+	var newHash func() hash.Hash
+	algorithm := params["algorithm"]
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	h := func(parts ...string) string {
+		d := newHash()
+		d.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	realm, nonce := params["realm"], params["nonce"]
+	uri := req.URL.RequestURI()
+	ha1 := h(s.username, realm, s.password)
+	ha2 := h(req.Method, uri)
+
+	fields := []string{
+		fmt.Sprintf(`username="%s"`, s.username),
+		fmt.Sprintf(`realm="%s"`, realm),
+		fmt.Sprintf(`nonce="%s"`, nonce),
+		fmt.Sprintf(`uri="%s"`, uri),
+	}
+
+	qop := ""
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	if params["qop"] != "" && qop == "" {
+		return "", fmt.Errorf("unsupported digest qop %q", params["qop"])
+	}
+
+	if qop == "" {
+		fields = append(fields, fmt.Sprintf(`response="%s"`, h(ha1, nonce, ha2)))
+	} else {
+		var raw [8]byte
+		if _, err := rand.Read(raw[:]); err != nil {
+			return "", err
+		}
+		cnonce := hex.EncodeToString(raw[:])
+		nc := "00000001"
+		fields = append(fields,
+			"qop="+qop,
+			"nc="+nc,
+			fmt.Sprintf(`cnonce="%s"`, cnonce),
+			fmt.Sprintf(`response="%s"`, h(ha1, nonce, nc, cnonce, qop, ha2)))
+	}
+	if algorithm != "" {
+		fields = append(fields, "algorithm="+algorithm)
+	}
+	if opaque, ok := params["opaque"]; ok {
+		fields = append(fields, fmt.Sprintf(`opaque="%s"`, opaque))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func getStateStatus(s *Store) error {
+	rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+	if err == nil {
+		rd.Close()
+	}
+	return err
+}
+
+func TestBasicChallenge(t *testing.T) {
+	var hits atomic.Int32
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Header.Get("Authorization") != want {
+			w.Header().Set("WWW-Authenticate", `Basic realm="repo", charset="UTF-8"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+
+	s, _ := newTestStore(t, h, map[string]string{"username": "alice", "password": "secret"})
+	if err := getStateStatus(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// without credentials the 401 is final, not retried
+	hits.Store(0)
+	s, _ = newTestStore(t, h, nil)
+	var se *statusErr
+	if err := getStateStatus(s); !errors.As(err, &se) || se.status != http.StatusUnauthorized {
+		t.Errorf("got %v, want the 401", err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("server hit %d times without credentials, want 1", n)
+	}
+}
+
+var authParam = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]+))`)
+
+// digestAuthServer checks Digest answers to its challenge on its own.
+func digestAuthServer(t *testing.T, algorithm, qop string, ok *atomic.Int32) http.HandlerFunc {
+	newHash := md5.New
+	if algorithm == "SHA-256" {
+		newHash = sha256.New
+	}
+	h := func(parts ...string) string {
+		d := newHash()
+		d.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth, found := strings.CutPrefix(r.Header.Get("Authorization"), "Digest ")
+		if found {
+			p := map[string]string{}
+			for _, m := range authParam.FindAllStringSubmatch(auth, -1) {
+				p[m[1]] = m[2] + m[3]
+			}
+			ha1 := h("alice", "repo", "secret")
+			ha2 := h(r.Method, r.URL.RequestURI())
+			want := h(ha1, "n0nce", ha2)
+			if qop != "" {
+				want = h(ha1, "n0nce", p["nc"], p["cnonce"], p["qop"], ha2)
+			}
+			if p["username"] == "alice" && p["uri"] == r.URL.RequestURI() && p["opaque"] == "0paque" && p["response"] == want {
+				ok.Add(1)
+				return
+			}
+			t.Errorf("wrong Digest answer %s", auth)
+		}
+		challenge := `Digest realm="repo", nonce="n0nce", opaque="0paque"`
+		if algorithm != "" {
+			challenge += ", algorithm=" + algorithm
+		}
+		if qop != "" {
+			challenge += `, qop="` + qop + `"`
+		}
+		w.Header().Add("WWW-Authenticate", `Newauth realm="apps"`)
+		w.Header().Add("WWW-Authenticate", challenge)
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+func TestDigestChallenge(t *testing.T) {
+	for _, test := range []struct{ algorithm, qop string }{
+		{"", ""},
+		{"MD5", "auth"},
+		{"SHA-256", "auth,auth-int"},
+	} {
+		var ok atomic.Int32
+		s, _ := newTestStore(t, digestAuthServer(t, test.algorithm, test.qop, &ok),
+			map[string]string{"username": "alice", "password": "secret"})
+		if err := getStateStatus(s); err != nil {
+			t.Errorf("algorithm %q, qop %q: %v", test.algorithm, test.qop, err)
+		}
+		if ok.Load() != 1 {
+			t.Errorf("algorithm %q, qop %q: the server took %d answers, want 1", test.algorithm, test.qop, ok.Load())
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+const defaultConcurrency = 8
+
+// BlobRequest is a byte range within a packfile.
+type BlobRequest struct {
+	MAC    objects.MAC
+	Offset uint64
+	Length uint32
+}
+
+type BlobResult struct {
+	Data []byte
+	Err  error
+}
+
+// GetPackfileBlobs fetches many blobs at once, keeping as many requests
+// in flight as the store allows.  Results are in the order of blobs and
+// a failed blob does not fail the others.
+func (s *Store) GetPackfileBlobs(ctx context.Context, blobs []BlobRequest) []BlobResult {
+	results := make([]BlobResult, len(blobs))
+	slots := make(chan struct{}, s.concurrency)
+
+	var wg sync.WaitGroup
+	for i, blob := range blobs {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i].Data, results[i].Err = s.getBlob(ctx, blob)
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (s *Store) getBlob(ctx context.Context, blob BlobRequest) ([]byte, error) {
+	rd, err := s.Get(ctx, storage.StorageResourcePackfile, blob.MAC, &storage.Range{
+		Offset: blob.Offset,
+		Length: blob.Length,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	return io.ReadAll(rd)
+}
+
+// GetPackfileBlobInto reads a blob straight into buf, saving hot restore
+// paths an allocation per blob.
+func (s *Store) GetPackfileBlobInto(ctx context.Context, mac objects.MAC, offset uint64, length uint32, buf []byte) (int, error) {
+	if len(buf) < int(length) {
+		return 0, fmt.Errorf("buffer of %d bytes too small for a %d bytes blob", len(buf), length)
+	}
+
+	rd, err := s.Get(ctx, storage.StorageResourcePackfile, mac, &storage.Range{
+		Offset: offset,
+		Length: length,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+
+	return io.ReadFull(rd, buf[:length])
+}
+
+// BatchError reports the items of a batch operation that failed, the
+// others went through.
+type BatchError struct {
+	Errs map[objects.MAC]error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d items of the batch failed", len(e.Errs))
+}
+
+var errStateNotFound = fmt.Errorf("state not found")
+
+// GetStatesData fetches several states in one request.  The states the
+// server doesn't have are reported in a *BatchError, along with those
+// found.  Servers without the batch endpoint get one request per state.
+func (s *Store) GetStatesData(ctx context.Context, macs []objects.MAC) (map[objects.MAC][]byte, error) {
+	payload, err := json.Marshal(macs)
+	if err != nil {
+		return nil, err
+	}
+
+	// keyed by hex MAC, a MAC can't be a JSON object key
+	reply, err := doRequest[map[string][]byte](ctx, s, &request{
+		op:     opGet,
+		method: "POST",
+		path:   "/resources/" + strres(storage.StorageResourceState) + "/batch",
+		body:   newRequestBody(bytes.NewReader(payload), nil),
+	})
+	if err != nil {
+		var serr *statusErr
+		if errors.As(err, &serr) && isUnsupported(serr.status) {
+			return s.getStatesOneByOne(ctx, macs)
+		}
+		return nil, err
+	}
+	found := make(map[objects.MAC][]byte, len(reply))
+	for key, data := range reply {
+		var mac objects.MAC
+		if raw, err := hex.DecodeString(key); err != nil || len(raw) != len(mac) {
+			return nil, fmt.Errorf("invalid MAC %q in batch reply", key)
+		} else {
+			copy(mac[:], raw)
+		}
+		found[mac] = data
+	}
+
+	errs := make(map[objects.MAC]error)
+	for _, mac := range macs {
+		if _, ok := found[mac]; !ok {
+			errs[mac] = errStateNotFound
+		}
+	}
+	if len(errs) != 0 {
+		return found, &BatchError{Errs: errs}
+	}
+	return found, nil
+}
+
+func (s *Store) getStatesOneByOne(ctx context.Context, macs []objects.MAC) (map[objects.MAC][]byte, error) {
+	found := make(map[objects.MAC][]byte)
+	errs := make(map[objects.MAC]error)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, s.concurrency)
+	for _, mac := range macs {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			data, err := s.getState(ctx, mac)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[mac] = err
+			} else {
+				found[mac] = data
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) != 0 {
+		return found, &BatchError{Errs: errs}
+	}
+	return found, nil
+}
+
+func (s *Store) getState(ctx context.Context, mac objects.MAC) ([]byte, error) {
+	rd, err := s.Get(ctx, storage.StorageResourceState, mac, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	return io.ReadAll(rd)
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// stateServer holds states, answering batch reads unless noBatch, and
+// logs every request it gets.
+type stateServer struct {
+	mu      sync.Mutex
+	states  map[string][]byte
+	noBatch bool
+	log     []string
+}
+
+func newStateServer(states map[objects.MAC]string) *stateServer {
+	srv := &stateServer{states: make(map[string][]byte)}
+	for mac, data := range states {
+		srv.states[hex.EncodeToString(mac[:])] = []byte(data)
+	}
+	return srv
+}
+
+func (srv *stateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.log = append(srv.log, fmt.Sprintf("%s %s nonce=%s tx=%s", r.Method, r.URL.Path,
+		r.Header.Get(nonceHeader), r.Header.Get(transactionHeader)))
+
+	switch {
+	case r.URL.Path == "/nonce":
+		w.Header().Set(nonceHeader, "n1")
+	case r.URL.Path == "/transactions":
+		io.WriteString(w, `{"id": "tx1"}`)
+	case strings.HasPrefix(r.URL.Path, "/transactions/"):
+	case r.URL.Path == "/resources/states/batch":
+		if srv.noBatch {
+			http.NotFound(w, r)
+			return
+		}
+		var macs []objects.MAC
+		json.NewDecoder(r.Body).Decode(&macs)
+		found := make(map[string][]byte)
+		for _, mac := range macs {
+			key := hex.EncodeToString(mac[:])
+			if data, ok := srv.states[key]; ok {
+				found[key] = data
+			}
+		}
+		json.NewEncoder(w).Encode(found)
+	case strings.HasPrefix(r.URL.Path, "/resources/states/"):
+		key := strings.TrimPrefix(r.URL.Path, "/resources/states/")
+		switch r.Method {
+		case "GET":
+			data, ok := srv.states[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		case "PUT":
+			srv.states[key], _ = io.ReadAll(r.Body)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (srv *stateServer) requests() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string(nil), srv.log...)
+}
+
+func TestGetStatesData(t *testing.T) {
+	for _, noBatch := range []bool{false, true} {
+		t.Run(fmt.Sprintf("noBatch=%v", noBatch), func(t *testing.T) {
+			srv := newStateServer(map[objects.MAC]string{{1}: "one", {2}: "two"})
+			srv.noBatch = noBatch
+			s, _ := newTestStore(t, srv, nil)
+
+			found, err := s.GetStatesData(context.Background(), []objects.MAC{{1}, {2}, {3}})
+			var berr *BatchError
+			if !errors.As(err, &berr) {
+				t.Fatalf("got error %v, want a *BatchError", err)
+			}
+			if len(berr.Errs) != 1 || berr.Errs[objects.MAC{3}] == nil {
+				t.Errorf("failed items %v, want state 3 alone", berr.Errs)
+			}
+			if len(found) != 2 || string(found[objects.MAC{1}]) != "one" || string(found[objects.MAC{2}]) != "two" {
+				t.Errorf("found %q, want states 1 and 2", found)
+			}
+		})
+	}
+}
+
+func TestBatchReadIsNotAWrite(t *testing.T) {
+	srv := newStateServer(map[objects.MAC]string{{1}: "one"})
+	s, _ := newTestStore(t, srv, map[string]string{"transactions": "true", "nonce_endpoint": "/nonce"})
+
+	if _, err := s.GetStatesData(context.Background(), []objects.MAC{{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.requests(); len(got) != 1 || got[0] != "POST /resources/states/batch nonce= tx=" {
+		t.Fatalf("batch read sent %q, want a bare POST", got)
+	}
+
+	if _, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{2}, bytes.NewReader([]byte("two"))); err != nil {
+		t.Fatal(err)
+	}
+	got := srv.requests()[1:]
+	want := []string{
+		"GET /nonce nonce= tx=",
+		"POST /transactions nonce=n1 tx=",
+		"PUT /resources/states/0200000000000000000000000000000000000000000000000000000000000000 nonce=n1 tx=tx1",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("write sent\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGetPackfileBlobs(t *testing.T) {
+	var mu sync.Mutex
+	inflight, most := 0, 0
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inflight++
+		most = max(most, inflight)
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inflight--
+			mu.Unlock()
+		}()
+
+		id := r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]
+		mac, _ := hex.DecodeString(id)
+		if mac[0] == 0xff {
+			http.NotFound(w, r)
+			return
+		}
+		// the first blobs asked for come back last
+		time.Sleep(time.Duration(10-mac[0]) * time.Millisecond)
+		data := fmt.Sprintf("packfile %d data", mac[0])
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	}), map[string]string{"batch_parallelism": "3", "max_retries": "0"})
+
+	var blobs []BlobRequest
+	for i := range 8 {
+		blobs = append(blobs, BlobRequest{MAC: objects.MAC{byte(i)}, Offset: 9, Length: 1})
+	}
+	blobs[5].MAC = objects.MAC{0xff}
+
+	results := s.GetPackfileBlobs(context.Background(), blobs)
+	if len(results) != len(blobs) {
+		t.Fatalf("got %d results for %d blobs", len(results), len(blobs))
+	}
+	for i, res := range results {
+		if i == 5 {
+			if res.Err == nil {
+				t.Errorf("blob %d of a missing packfile: no error", i)
+			}
+			continue
+		}
+		if want := fmt.Sprint(i); res.Err != nil || string(res.Data) != want {
+			t.Errorf("blob %d: %q, %v, want %q", i, res.Data, res.Err, want)
+		}
+	}
+	if most < 2 || most > 3 {
+		t.Errorf("%d requests in flight at most, want up to 3 in parallel", most)
+	}
+}
+
+func TestGetPackfileBlobInto(t *testing.T) {
+	s, _ := newTestStore(t, &objectServer{data: []byte("0123456789"), etag: `"v1"`}, nil)
+	ctx := context.Background()
+
+	buf := bytes.Repeat([]byte{'.'}, 6)
+	n, err := s.GetPackfileBlobInto(ctx, objects.MAC{1}, 3, 4, buf)
+	if err != nil || n != 4 || string(buf) != "3456.." {
+		t.Errorf("read %d bytes, %v, buffer %q, want 4 bytes and %q", n, err, buf, "3456..")
+	}
+
+	_, err = s.GetPackfileBlobInto(ctx, objects.MAC{1}, 3, 4, make([]byte, 3))
+	if err == nil || !strings.Contains(err.Error(), "too small") {
+		t.Errorf("undersized buffer: got %v", err)
+	}
+
+	// the packfile is shorter than the blob
+	n, err = s.GetPackfileBlobInto(ctx, objects.MAC{1}, 8, 4, buf)
+	if err == nil {
+		t.Errorf("blob past the end of the packfile: read %d bytes and no error", n)
+	}
+}
+
+func BenchmarkGetPackfileBlobInto(b *testing.B) {
+	s, _ := newTestStore(b, &objectServer{data: make([]byte, 1<<20), etag: `"v1"`}, nil)
+	buf := make([]byte, 64<<10)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for b.Loop() {
+		if _, err := s.GetPackfileBlobInto(context.Background(), objects.MAC{1}, 4096, uint32(len(buf)), buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// inflightCounter is a handler keeping track of the most requests it
+// had in flight at once.
+type inflightCounter struct {
+	mu             sync.Mutex
+	inflight, most int
+}
+
+func (c *inflightCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	c.inflight++
+	c.most = max(c.most, c.inflight)
+	c.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	c.mu.Lock()
+	c.inflight--
+	c.mu.Unlock()
+	if strings.HasSuffix(r.URL.Path, "/batch") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write([]byte("some state or blob"))
+}
+
+func TestBatchParallelism(t *testing.T) {
+	for _, test := range []struct {
+		config map[string]string
+		want   int
+	}{
+		{nil, defaultConcurrency},
+		{map[string]string{"batch_parallelism": "1"}, 1},
+		{map[string]string{"batch_parallelism": "5"}, 5},
+		{map[string]string{"max_connections": "2"}, 2},
+	} {
+		blobsSrv := &inflightCounter{}
+		s, _ := newTestStore(t, blobsSrv, test.config)
+		blobs := make([]BlobRequest, 20)
+		for i := range blobs {
+			blobs[i] = BlobRequest{MAC: objects.MAC{byte(i)}, Offset: 0, Length: 4}
+		}
+		for i, res := range s.GetPackfileBlobs(context.Background(), blobs) {
+			if res.Err != nil || string(res.Data) != "some" {
+				t.Fatalf("%v: blob %d: %q, %v", test.config, i, res.Data, res.Err)
+			}
+		}
+
+		statesSrv := &inflightCounter{}
+		s, _ = newTestStore(t, statesSrv, test.config)
+		macs := make([]objects.MAC, 20)
+		for i := range macs {
+			macs[i] = objects.MAC{byte(i)}
+		}
+		if _, err := s.GetStatesData(context.Background(), macs); err != nil {
+			t.Fatalf("%v: %v", test.config, err)
+		}
+
+		for what, srv := range map[string]*inflightCounter{"blobs": blobsSrv, "states": statesSrv} {
+			if srv.most != test.want {
+				t.Errorf("%v: %d %s requests in flight at most, want %d", test.config, srv.most, what, test.want)
+			}
+		}
+	}
+}
+
+func TestBatchParallelismConfig(t *testing.T) {
+	for _, value := range []string{"0", "-1", "many"} {
+		if _, err := newStore(map[string]string{"location": "http://localhost", "batch_parallelism": value}); err == nil {
+			t.Errorf("batch_parallelism %q accepted", value)
+		}
+	}
+}
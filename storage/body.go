@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+)
+
+var errNotReplayable = fmt.Errorf("request body cannot be sent again")
+
+// requestBody wraps an upload so that it is counted and hashed as it
+// goes out and, when the underlying reader can seek, sent again from
+// the start.
+//
+// The transport may keep reading a body after it got a response, so
+// every attempt reads through its own handle and rewinding cuts the
+// previous handles off.
+type requestBody struct {
+	rd    io.Reader
+	size  int64
+	start int64
+	h     hash.Hash
+
+	// start of the body, kept with body_capture
+	capture *snippet
+
+	mu      sync.Mutex
+	n       int64
+	gen     int
+	drained bool
+}
+
+func newRequestBody(rd io.Reader, h hash.Hash) *requestBody {
+	b := &requestBody{rd: rd, size: knownSize(rd), start: -1, h: h}
+	if sk, ok := rd.(io.Seeker); ok {
+		if pos, err := sk.Seek(0, io.SeekCurrent); err == nil {
+			b.start = pos
+		}
+	}
+	return b
+}
+
+func (b *requestBody) attempt() io.Reader {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &bodyAttempt{b: b, gen: b.gen}
+}
+
+func (b *requestBody) rewind() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.n == 0 && !b.drained {
+		b.gen++
+		return nil
+	}
+	if b.start < 0 {
+		return errNotReplayable
+	}
+	if _, err := b.rd.(io.Seeker).Seek(b.start, io.SeekStart); err != nil {
+		return err
+	}
+	b.n = 0
+	b.drained = false
+	if b.h != nil {
+		b.h.Reset()
+	}
+	b.gen++
+	return nil
+}
+
+// drain consumes whatever is left of the underlying reader, cutting off
+// any attempt still holding it.
+func (b *requestBody) drain() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.drained = true
+	b.gen++
+	w := io.Discard
+	if b.h != nil {
+		w = b.h
+	}
+	k, err := io.Copy(w, b.rd)
+	b.n += k
+	return err
+}
+
+// digest hashes a body of known length that can be read again, leaving
+// it where it was.  ok is false for any other body.
+func (b *requestBody) digest(h hash.Hash) (sum []byte, ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.size < 0 || b.start < 0 {
+		return nil, false, nil
+	}
+	sk := b.rd.(io.Seeker)
+	if _, err := io.Copy(h, io.LimitReader(b.rd, b.size)); err != nil {
+		return nil, false, err
+	}
+	if _, err := sk.Seek(b.start, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+	return h.Sum(nil), true, nil
+}
+
+func (b *requestBody) count() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
+
+func (b *requestBody) sum() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.h.Sum(nil)
+}
+
+type bodyAttempt struct {
+	b   *requestBody
+	gen int
+}
+
+func (a *bodyAttempt) Read(p []byte) (int, error) {
+	b := a.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.drained || a.gen != b.gen {
+		return 0, io.ErrClosedPipe
+	}
+	k, err := b.rd.Read(p)
+	if k > 0 && b.h != nil {
+		b.h.Write(p[:k])
+	}
+	if k > 0 && b.capture != nil && b.n < captureSnippetSize {
+		b.capture.write(b.n, p[:k])
+	}
+	b.n += int64(k)
+	return k, err
+}
+
+// knownSize returns how many bytes are left to read from rd when that
+// can be found out without consuming it, -1 otherwise.
+func knownSize(rd io.Reader) int64 {
+	switch v := rd.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case io.Seeker:
+		cur, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		end, err := v.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1
+		}
+		if _, err := v.Seek(cur, io.SeekStart); err != nil {
+			return -1
+		}
+		return end - cur
+	default:
+		return -1
+	}
+}
+
+// copyBuffer hands its reader to the transport through WriteTo, so that
+// uploads are copied through a buffer of the configured size rather
+// than the one io.Copy picks.  The transport hides WriteTo behind a
+// LimitReader when the length is known, reads are then capped to the
+// size instead.  The transport closes it once done with the body,
+// which stops the compression behind rd when the server answered
+// before reading it all.
+type copyBuffer struct {
+	rd     io.Reader
+	size   int
+	closer io.Closer
+}
+
+func (c *copyBuffer) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+func (c *copyBuffer) Read(p []byte) (int, error) {
+	if len(p) > c.size {
+		p = p[:c.size]
+	}
+	return c.rd.Read(p)
+}
+
+func (c *copyBuffer) WriteTo(w io.Writer) (int64, error) {
+	// rd is wrapped so that CopyBuffer doesn't hand over to a WriterTo
+	// or ReaderFrom of its own and skip the buffer.
+	return io.CopyBuffer(onlyWriter{w}, onlyReader{c.rd}, make([]byte, c.size))
+}
+
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
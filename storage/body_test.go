@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func discardHandler(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+}
+
+// readSizes records the largest read made from it.
+type readSizes struct {
+	rd  io.Reader
+	max int
+}
+
+func (r *readSizes) Read(p []byte) (int, error) {
+	r.max = max(r.max, len(p))
+	return r.rd.Read(p)
+}
+
+// knownReadSizes tells its length, as a bytes.Reader would.
+type knownReadSizes struct {
+	*readSizes
+	br *bytes.Reader
+}
+
+func (r knownReadSizes) Len() int { return r.br.Len() }
+
+func TestUploadChunkSize(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	s, _ := newTestStore(t, http.HandlerFunc(discardHandler), map[string]string{"upload_chunk_size": "4096"})
+
+	for _, known := range []bool{true, false} {
+		br := bytes.NewReader(data)
+		sizes := &readSizes{rd: br}
+		var rd io.Reader = sizes
+		if known {
+			rd = knownReadSizes{readSizes: sizes, br: br}
+		}
+		if _, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, rd); err != nil {
+			t.Fatal(err)
+		}
+		if sizes.max > 4096 {
+			t.Errorf("known length %v: read %d bytes at once, want at most 4096", known, sizes.max)
+		}
+	}
+}
+
+func BenchmarkUploadChunkSize(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 8<<20)
+	for _, size := range []int{4 << 10, 32 << 10, 1 << 20} {
+		for _, known := range []bool{true, false} {
+			b.Run(fmt.Sprintf("%d/known=%v", size, known), func(b *testing.B) {
+				s, _ := newTestStore(b, http.HandlerFunc(discardHandler), map[string]string{"upload_chunk_size": strconv.Itoa(size)})
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+				for range b.N {
+					var rd io.Reader = bytes.NewReader(data)
+					if !known {
+						rd = io.MultiReader(rd)
+					}
+					if _, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, rd); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestUploadContentLength(t *testing.T) {
+	data := []byte("0123456789")
+	for _, test := range []struct {
+		name    string
+		rd      io.Reader
+		length  int64
+		chunked bool
+	}{
+		{"bytes.Reader", bytes.NewReader(data), 10, false},
+		{"bytes.Buffer", bytes.NewBuffer(data), 10, false},
+		{"stream", io.MultiReader(bytes.NewReader(data)), -1, true},
+	} {
+		var length int64
+		var encoding []string
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			length = r.ContentLength
+			encoding = r.TransferEncoding
+		}), nil)
+
+		if _, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, test.rd); err != nil {
+			t.Fatal(err)
+		}
+		if length != test.length {
+			t.Errorf("%s: Content-Length %d, want %d", test.name, length, test.length)
+		}
+		if chunked := len(encoding) == 1 && encoding[0] == "chunked"; chunked != test.chunked {
+			t.Errorf("%s: Transfer-Encoding %q, want chunked %v", test.name, encoding, test.chunked)
+		}
+	}
+}
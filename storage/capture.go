@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// captureSnippetSize is how much of each body is kept, enough to make
+// out a JSON error or the start of a state.
+const captureSnippetSize = 512
+
+// BodyCapture is the start of the bodies of one exchange with the
+// server, as kept with body_capture.
+type BodyCapture struct {
+	Time     time.Time
+	Method   string
+	Path     string
+	Status   int // 0 when no response came back
+	Err      string
+	Request  []byte
+	Response []byte
+}
+
+// snippet holds the first captureSnippetSize bytes written to it.  It
+// is filled as the body is read, while BodyCaptures may look at it.
+type snippet struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// write records p as found at offset off of the body, so that a body
+// read again from the start after a rewind starts over.
+func (sn *snippet) write(off int64, p []byte) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	if off == 0 {
+		sn.buf = sn.buf[:0]
+	}
+	if off != int64(len(sn.buf)) {
+		return
+	}
+	n := min(len(p), captureSnippetSize-len(sn.buf))
+	sn.buf = append(sn.buf, p[:n]...)
+}
+
+func (sn *snippet) bytes() []byte {
+	if sn == nil {
+		return nil
+	}
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	return bytes.Clone(sn.buf)
+}
+
+type capture struct {
+	time     time.Time
+	method   string
+	path     string
+	status   int
+	err      string
+	request  *snippet
+	response *snippet
+}
+
+// captureRing keeps the last captures, overwriting the oldest.
+type captureRing struct {
+	mu      sync.Mutex
+	entries []*capture
+	next    int
+	full    bool
+}
+
+func newCaptureRing(size int) *captureRing {
+	return &captureRing{entries: make([]*capture, size)}
+}
+
+func (c *captureRing) add(e *capture) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[c.next] = e
+	c.next = (c.next + 1) % len(c.entries)
+	if c.next == 0 {
+		c.full = true
+	}
+}
+
+func (c *captureRing) snapshot() []*capture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.full {
+		return append([]*capture(nil), c.entries[:c.next]...)
+	}
+	return append(append([]*capture(nil), c.entries[c.next:]...), c.entries[:c.next]...)
+}
+
+// capturingBody copies the start of a response into a snippet as the
+// caller reads it, the body is never read ahead.
+type capturingBody struct {
+	*releasingBody
+	sn *snippet
+	n  int64
+}
+
+func (b *capturingBody) Read(p []byte) (int, error) {
+	k, err := b.releasingBody.Read(p)
+	if k > 0 && b.n < captureSnippetSize {
+		b.sn.write(b.n, p[:k])
+	}
+	b.n += int64(k)
+	return k, err
+}
+
+var secretFields = regexp.MustCompile(`(?i)("[^"]*(?:token|password|secret|authorization|key)[^"]*"\s*:\s*)"[^"]*"`)
+
+const redacted = "[REDACTED]"
+
+// redact hides the credentials of the store, and the values of JSON
+// fields named after secrets, from a snippet.
+func (s *Store) redact(p []byte) []byte {
+	for _, secret := range []string{s.authToken, s.password, s.cdnAuthToken} {
+		if secret != "" {
+			p = bytes.ReplaceAll(p, []byte(secret), []byte(redacted))
+		}
+	}
+	return secretFields.ReplaceAll(p, []byte(`$1"`+redacted+`"`))
+}
+
+// BodyCaptures returns the start of the request and response bodies of
+// the last exchanges with the server, oldest first, with the store's
+// credentials and fields looking like secrets redacted.  It is empty
+// unless body_capture is set.  A response shows as much of its body as
+// was read so far.
+func (s *Store) BodyCaptures() []BodyCapture {
+	if s.captures == nil {
+		return nil
+	}
+	entries := s.captures.snapshot()
+	out := make([]BodyCapture, len(entries))
+	for i, e := range entries {
+		out[i] = BodyCapture{
+			Time:     e.time,
+			Method:   e.method,
+			Path:     e.path,
+			Status:   e.status,
+			Err:      string(s.redact([]byte(e.err))),
+			Request:  s.redact(e.request.bytes()),
+			Response: s.redact(e.response.bytes()),
+		}
+	}
+	return out
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// echoServer answers every request with its body, prefixed.
+func echoServer(w http.ResponseWriter, r *http.Request) {
+	data, _ := io.ReadAll(r.Body)
+	fmt.Fprintf(w, "got %s", data)
+}
+
+func TestBodyCaptureRing(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(echoServer), map[string]string{"body_capture": "3"})
+	ctx := context.Background()
+
+	for i := range 5 {
+		if _, err := s.Put(ctx, storage.StorageResourceState, objects.MAC{byte(i)}, strings.NewReader(fmt.Sprintf("state %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	captures := s.BodyCaptures()
+	if len(captures) != 3 {
+		t.Fatalf("kept %d captures, want the last 3", len(captures))
+	}
+	for i, c := range captures {
+		want := fmt.Sprintf("state %d", i+2)
+		if c.Method != "PUT" || c.Status != http.StatusOK || string(c.Request) != want || c.Time.IsZero() ||
+			c.Path != fmt.Sprintf("/resources/states/%016x", objects.MAC{byte(i + 2)}) {
+			t.Errorf("capture %d: %s %s %d %q, want the upload of %q", i, c.Method, c.Path, c.Status, c.Request, want)
+		}
+	}
+}
+
+func TestBodyCaptureResponse(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 4096))
+	}), map[string]string{"body_capture": "2"})
+
+	rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only what was read shows
+	io.CopyN(io.Discard, rd, 10)
+	if got := s.BodyCaptures()[0].Response; string(got) != "xxxxxxxxxx" {
+		t.Errorf("response capture %q after reading 10 bytes", got)
+	}
+	io.Copy(io.Discard, rd)
+	rd.Close()
+	if got := s.BodyCaptures()[0].Response; len(got) != captureSnippetSize {
+		t.Errorf("response capture of %d bytes, want the first %d", len(got), captureSnippetSize)
+	}
+}
+
+func TestBodyCaptureRedacted(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(echoServer), map[string]string{"body_capture": "1", "auth_token": "t0k3n"})
+
+	body := `{"note": "bearer t0k3n", "api_key": "abc123", "Password" : "hunter2", "size": "12"}`
+	if _, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	c := s.BodyCaptures()[0]
+	want := `{"note": "bearer [REDACTED]", "api_key": "[REDACTED]", "Password" : "[REDACTED]", "size": "12"}`
+	if string(c.Request) != want {
+		t.Errorf("request capture %s, want %s", c.Request, want)
+	}
+	for _, secret := range []string{"t0k3n", "abc123", "hunter2"} {
+		if bytes.Contains(c.Response, []byte(secret)) {
+			t.Errorf("response capture %s shows %s", c.Response, secret)
+		}
+	}
+}
+
+func TestBodyCaptureFailure(t *testing.T) {
+	s, err := newStore(map[string]string{"location": "http://" + closedPort(t), "body_capture": "1", "max_retries": "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(context.Background())
+
+	s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, strings.NewReader("state"))
+	c := s.BodyCaptures()
+	if len(c) != 1 || c[0].Status != 0 || c[0].Err == "" {
+		t.Fatalf("failed exchange captured as %+v, want no status and the error", c)
+	}
+}
+
+func TestBodyCaptureOff(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(echoServer), nil)
+	if _, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, strings.NewReader("state")); err != nil {
+		t.Fatal(err)
+	}
+	if c := s.BodyCaptures(); c != nil {
+		t.Errorf("captured %v without body_capture", c)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// chunkManifest lists, in order, the chunks a server stored a large
+// packfile as.
+type chunkManifest struct {
+	Chunks []struct {
+		ID   string `json:"id"`
+		Size int64  `json:"size"`
+	} `json:"chunks"`
+}
+
+// getChunked fetches the manifest of the object at uri and returns a
+// reader stitching its chunks together.  ok is false when the server
+// has no manifest for it, and the object should be fetched whole.
+func (s *Store) getChunked(ctx context.Context, uri string) (rc io.ReadCloser, ok bool, err error) {
+	manifest, err := doRequest[chunkManifest](ctx, s, &request{op: opGet, method: "GET", path: uri + "/manifest"})
+	if err != nil {
+		var serr *statusErr
+		if errors.As(err, &serr) && isUnsupported(serr.status) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	chunks := make([]chunkRef, len(manifest.Chunks))
+	for i, chunk := range manifest.Chunks {
+		if chunk.Size < 0 {
+			return nil, false, fmt.Errorf("invalid size %d for chunk %q in manifest", chunk.Size, chunk.ID)
+		}
+		chunks[i] = chunkRef{id: chunk.ID, size: chunk.Size}
+	}
+	return &chunkedReader{ctx: ctx, s: s, uri: uri, chunks: chunks}, true, nil
+}
+
+type chunkRef struct {
+	id   string
+	size int64
+}
+
+// chunkedReader reads the chunks of an object one after the other.  A
+// chunk failing or ending short of its size midway is fetched again and
+// read from where it broke, the chunks before it are not.  Anything past
+// the size of a chunk is left unread.
+type chunkedReader struct {
+	ctx    context.Context
+	s      *Store
+	uri    string
+	chunks []chunkRef
+
+	cur   io.ReadCloser
+	idx   int
+	read  int64
+	tries int
+}
+
+func (c *chunkedReader) open() error {
+	r, err := c.s.sendRequest(withObjectFetch(c.ctx), &request{
+		op:     opGet,
+		method: "GET",
+		path:   c.uri + "/chunks/" + url.PathEscape(c.chunks[c.idx].id),
+	})
+	if err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusOK {
+		defer r.Body.Close()
+		return c.s.statusError(r)
+	}
+	if _, err := io.CopyN(io.Discard, r.Body, c.read); err != nil {
+		r.Body.Close()
+		return err
+	}
+	c.cur = c.s.downloadLimiter.readCloser(c.ctx, r.Body)
+	return nil
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if c.idx >= len(c.chunks) {
+			return 0, io.EOF
+		}
+		if c.cur == nil {
+			if err := c.open(); err != nil {
+				return 0, err
+			}
+		}
+
+		chunk := c.chunks[c.idx]
+		buf := p
+		if left := chunk.size - c.read; int64(len(buf)) > left {
+			buf = buf[:left]
+		}
+		k, err := 0, io.EOF
+		if len(buf) > 0 {
+			k, err = c.cur.Read(buf)
+		}
+		c.read += int64(k)
+		if err == nil && c.read == chunk.size {
+			err = io.EOF
+		}
+		if err == io.EOF && c.read < chunk.size {
+			err = fmt.Errorf("chunk %q ended after %d of its %d bytes: %w", chunk.id, c.read, chunk.size, io.ErrUnexpectedEOF)
+		}
+		switch {
+		case err == io.EOF:
+			c.cur.Close()
+			c.cur = nil
+			c.idx++
+			c.read = 0
+			c.tries = 0
+		case err != nil:
+			c.cur.Close()
+			c.cur = nil
+			if c.tries++; c.tries > c.s.retry.maxRetries || c.ctx.Err() != nil {
+				return k, err
+			}
+		}
+		if k > 0 {
+			return k, nil
+		}
+	}
+}
+
+func (c *chunkedReader) Close() error {
+	if c.cur != nil {
+		err := c.cur.Close()
+		c.cur = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// chunkServer serves a packfile as the chunks in data, cutting the
+// first short answers of each chunk in half.
+type chunkServer struct {
+	chunks []string
+	short  int
+
+	mu     sync.Mutex
+	served map[string]int
+}
+
+func (c *chunkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/manifest") {
+		var manifest chunkManifest
+		for i, data := range c.chunks {
+			manifest.Chunks = append(manifest.Chunks, struct {
+				ID   string `json:"id"`
+				Size int64  `json:"size"`
+			}{string(rune('a' + i)), int64(len(data))})
+		}
+		json.NewEncoder(w).Encode(manifest)
+		return
+	}
+	_, id, ok := strings.Cut(r.URL.Path, "/chunks/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data := c.chunks[id[0]-'a']
+
+	c.mu.Lock()
+	c.served[id]++
+	short := c.served[id] <= c.short
+	c.mu.Unlock()
+	if short {
+		data = data[:len(data)/2]
+	}
+	io.WriteString(w, data)
+}
+
+func readPackfile(s *Store) (string, error) {
+	rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, nil)
+	if err != nil {
+		return "", err
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	return string(data), err
+}
+
+func TestChunkedPackfile(t *testing.T) {
+	srv := &chunkServer{chunks: []string{"first chunk,", "second chunk,", "third chunk"}, served: map[string]int{}}
+	s, _ := newTestStore(t, srv, map[string]string{"chunked_packfiles": "true"})
+
+	got, err := readPackfile(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(srv.chunks, ""); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestChunkedPackfileShortChunk(t *testing.T) {
+	srv := &chunkServer{chunks: []string{"first chunk,", "second chunk"}, short: 1, served: map[string]int{}}
+	s, _ := newTestStore(t, srv, map[string]string{"chunked_packfiles": "true"})
+
+	got, err := readPackfile(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(srv.chunks, ""); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if srv.served["a"] != 2 || srv.served["b"] != 2 {
+		t.Errorf("chunks fetched %v times, want each twice", srv.served)
+	}
+}
+
+func TestChunkedPackfileTruncated(t *testing.T) {
+	srv := &chunkServer{chunks: []string{"first chunk,", "second chunk"}, short: 100, served: map[string]int{}}
+	s, _ := newTestStore(t, srv, map[string]string{"chunked_packfiles": "true", "max_retries": "2"})
+
+	if _, err := readPackfile(s); err == nil || !strings.Contains(err.Error(), "ended after") {
+		t.Fatalf("got error %v, want the short chunk reported", err)
+	}
+}
+
+func TestChunkedPackfileNoManifest(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/manifest") {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "whole packfile")
+	}), map[string]string{"chunked_packfiles": "true"})
+
+	got, err := readPackfile(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "whole packfile" {
+		t.Errorf("got %q, want the whole packfile", got)
+	}
+}
@@ -17,24 +17,177 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"mime"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/PlakarKorp/kloset/connectors/storage"
 	"github.com/PlakarKorp/kloset/location"
 	"github.com/PlakarKorp/kloset/objects"
+	"github.com/google/uuid"
 )
 
+// idempotencyHeader lets the server recognize a PUT it already applied
+// when the same upload is sent again.
+const idempotencyHeader = "Idempotency-Key"
+
+// ttlHeader asks the server to expire an object after that many
+// seconds, servers that don't expire objects just ignore it.
+const ttlHeader = "X-Object-Ttl"
+
+var defaultErrorFields = []string{"Err", "error", "message"}
+
+// namespaceHeader repeats the namespace that prefixes request paths,
+// for servers routing on it.
+const namespaceHeader = "X-Namespace"
+
+const storageClassHeader = "X-Storage-Class"
+
+// cursorHeader points at the next page of a listing, it is absent on
+// the last one.
+const cursorHeader = "X-Next-Cursor"
+
+// watermarkHeader marks how far a listing went, for the next one to
+// list only what was added since.
+const watermarkHeader = "X-Watermark"
+
+const (
+	defaultUploadChunkSize = 32 << 10
+	minUploadChunkSize     = 4 << 10
+	maxUploadChunkSize     = 16 << 20
+)
+
+const (
+	defaultListPageSize = 1000
+	maxListPageSize     = 100000
+)
+
+var ErrMacConflict = fmt.Errorf("object already exists with different content")
+var ErrUnsupported = fmt.Errorf("operation not supported by the server")
+var ErrPreconditionFailed = fmt.Errorf("object changed on the server")
+
+var errStoreClosed = fmt.Errorf("store closed")
+
 type Store struct {
+	// every request derives from ctx, Close cancels it
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	config     storage.Configuration
 	Repository string
 	location   *url.URL
 	authToken  string
+	username   string
+	password   string
+	clock      clock
+	client     *http.Client
+	transport  *http.Transport
+	sharedPool bool
+	retry      retryPolicy
+	jitter     jitter
+	logger     *slog.Logger
+
+	openTimeout time.Duration
+	openRetry   retryPolicy
+
+	createMethod string
+	updateMethod string
+	existing     existing
+
+	objectTTL         time.Duration
+	storageClass      string
+	retrievalPoll     time.Duration
+	retrievalMaxWait  time.Duration
+	conditionalDelete bool
+	compress          map[storage.StorageResource]bool
+	encodingRejected  atomic.Bool
+
+	// lets several repositories share a server, everything the store
+	// does happens under /namespaces/<namespace>
+	namespace     string
+	namespacePath string
+
+	// packfiles may be stored as chunks listed in a manifest
+	chunkedPackfiles bool
+
+	// extra query parameters, by operation
+	opQuery map[string]url.Values
+
+	// Diagnose may write, read back and delete a lock
+	diagnoseWrite bool
+
+	// the last exchanges, kept with body_capture
+	captures *captureRing
+
+	// how many requests a batch operation keeps in flight
+	concurrency  int
+	listPageSize int
+
+	listIntervals map[storage.StorageResource]*debouncedList
+	stateCache    *stateCache
+	prefetch      *prefetcher
+	flights       *flights
+	tx            *transaction
+
+	cdnAuthToken        string
+	redirectHosts       []string
+	errorFields         []string
+	strictContentType   bool
+	envelope            bool
+	maxDecompressedSize int64
+	brotli              bool
+	uploadContentType   string
+	eagerConnect        bool
+	expectContinue      bool
+	integrity           integrityAlgo
+	verifyRetriedStates bool
+	continueShortRanges bool
+	contentRange        contentRangeMode
+	verifyTrailerDigest bool
+	uploadEncoding      string
+
+	uploadChunkSize int
+	uploadLimiter   *bandwidthLimiter
+	downloadLimiter *bandwidthLimiter
+
+	nonces *nonces
+
+	stats            stats
+	auditMu          sync.Mutex
+	auditHook        func(AuditEntry)
+	connHook         atomic.Pointer[func(ConnEvent)]
+	etags            etags
+	patchUnsupported atomic.Bool
+
+	negotiate NegotiateProvider
+
+	ctxHeadersMu sync.Mutex
+	ctxHeaders   map[any]string
+
+	serverVersion atomic.Pointer[string]
+	apiVersions   []string
+	apiPrefix     atomic.Pointer[string]
+	versionMin    string
+	versionMax    string
+
+	autoHTTPS bool
+	httpsPort string
+	upgraded  atomic.Pointer[url.URL]
 }
 
 func init() {
@@ -43,15 +196,373 @@ func init() {
 }
 
 func NewStore(ctx context.Context, proto string, storeConfig map[string]string) (storage.Store, error) {
+	s, err := newStore(storeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// an unreachable server or bad credentials are reported now
+	// rather than on first use.
+	if s.eagerConnect {
+		if _, err := s.Open(ctx); err != nil {
+			s.Close(ctx)
+			return nil, fmt.Errorf("connecting to %s: %w", s.location.Host, err)
+		}
+	}
+	return s, nil
+}
+
+// ValidateConfig runs all the checks NewStore does on a configuration,
+// without talking to the server.
+func ValidateConfig(storeConfig map[string]string) error {
+	s, err := buildStore(storeConfig, realClock{}, true)
+	if err != nil {
+		return err
+	}
+	// nothing was sent, closing only lets go of the store's context
+	return s.Close(context.Background())
+}
+
+// newStore builds a store out of its configuration, it must not do any
+// network I/O so that ValidateConfig can rely on it.
+func newStore(storeConfig map[string]string) (*Store, error) {
+	return newStoreWithClock(storeConfig, realClock{})
+}
+
+// newStoreWithClock builds a store whose every wait and timestamp, the
+// retry backoffs, bandwidth limits and injected faults included, goes
+// through clock.
+func newStoreWithClock(storeConfig map[string]string, clock clock) (*Store, error) {
+	return buildStore(storeConfig, clock, false)
+}
+
+// buildStore is newStoreWithClock, for a store that is only validated
+// if validating: it is then left out of the shared connection pools,
+// which would keep it around for good.
+func buildStore(storeConfig map[string]string, clock clock, validating bool) (*Store, error) {
+	storeConfig, err := loadConfigFile(storeConfig)
+	if err != nil {
+		return nil, err
+	}
+	if storeConfig, err = loadLocationOptions(storeConfig); err != nil {
+		return nil, err
+	}
+
 	location, err := url.Parse(storeConfig["location"])
 	if err != nil {
-		return nil, fmt.Errorf("invalid URL %q: %w", storeConfig["location"], err)
+		return nil, fmt.Errorf("invalid URL %q: %w", redactURL(storeConfig["location"]), urlError(err))
+	}
+	if location.Scheme != "http" && location.Scheme != "https" {
+		return nil, fmt.Errorf("invalid URL %q: expected an http or https URL", location.Redacted())
+	}
+	if location.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q: missing host", location.Redacted())
+	}
+
+	maxUpload, err := parseBandwidth(storeConfig, "max_upload_bandwidth")
+	if err != nil {
+		return nil, err
+	}
+	maxDownload, err := parseBandwidth(storeConfig, "max_download_bandwidth")
+	if err != nil {
+		return nil, err
+	}
+
+	tc, err := parseTransportConfig(storeConfig)
+	if err != nil {
+		return nil, err
+	}
+	tc.serverNameHost = location.Hostname()
+	retry, err := parseRetryPolicy(storeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		location:        location,
+		authToken:       storeConfig["auth_token"],
+		username:        storeConfig["username"],
+		password:        storeConfig["password"],
+		cdnAuthToken:    storeConfig["cdn_auth_token"],
+		storageClass:    storeConfig["storage_class"],
+		redirectHosts:   parseAllowedHosts(storeConfig),
+		clock:           clock,
+		retry:           retry,
+		logger:          slog.Default(),
+		uploadLimiter:   newBandwidthLimiter(clock, maxUpload),
+		downloadLimiter: newBandwidthLimiter(clock, maxDownload),
+	}
+	s.concurrency = defaultConcurrency
+	if tc.maxConns > 0 {
+		s.concurrency = min(s.concurrency, tc.maxConns)
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	if tc.shared && !validating {
+		s.transport = sharedTransport(location.Scheme+"://"+location.Host, tc)
+	} else {
+		s.transport = newTransport(tc)
+	}
+	s.sharedPool = tc.shared
+	s.negotiate = tc.negotiate
+
+	var transport http.RoundTripper = s.transport
+	rate, delay, err := parseFaultInjection(storeConfig)
+	if err != nil {
+		return nil, err
+	}
+	if rate > 0 {
+		transport = &faultInjector{next: transport, clock: clock, rand: &s.jitter, rate: rate, delay: delay}
+	}
+
+	s.client = &http.Client{
+		Transport:     transport,
+		CheckRedirect: s.checkRedirect,
+	}
+
+	s.errorFields = defaultErrorFields
+	if value, ok := storeConfig["error_fields"]; ok {
+		s.errorFields = nil
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				s.errorFields = append(s.errorFields, field)
+			}
+		}
+	}
+
+	if s.strictContentType, err = parseBool(storeConfig, "strict_content_type"); err != nil {
+		return nil, err
+	}
+	if s.envelope, err = parseProtocol(storeConfig); err != nil {
+		return nil, err
+	}
+
+	s.maxDecompressedSize = defaultMaxDecompressedSize
+	if _, ok := storeConfig["max_decompressed_size"]; ok {
+		if s.maxDecompressedSize, err = parseSize(storeConfig, "max_decompressed_size"); err != nil {
+			return nil, err
+		}
+	}
+
+	s.verifyTrailerDigest = true
+	if _, ok := storeConfig["verify_trailer_digest"]; ok {
+		if s.verifyTrailerDigest, err = parseBool(storeConfig, "verify_trailer_digest"); err != nil {
+			return nil, err
+		}
+	}
+
+	s.uploadChunkSize = defaultUploadChunkSize
+	if _, ok := storeConfig["upload_chunk_size"]; ok {
+		size, err := parseSize(storeConfig, "upload_chunk_size")
+		if err != nil {
+			return nil, err
+		}
+		if size < minUploadChunkSize || size > maxUploadChunkSize {
+			return nil, fmt.Errorf("invalid upload_chunk_size %d: expected between %d and %d bytes",
+				size, minUploadChunkSize, maxUploadChunkSize)
+		}
+		s.uploadChunkSize = int(size)
+	}
+
+	readAhead, err := parseSize(storeConfig, "read_ahead")
+	if err != nil {
+		return nil, err
+	}
+	if readAhead > math.MaxUint32 {
+		return nil, fmt.Errorf("invalid read_ahead %d: at most %d bytes", readAhead, uint32(math.MaxUint32))
+	}
+	s.prefetch = newPrefetcher(readAhead)
+
+	if s.integrity, err = parseIntegrityAlgo(storeConfig); err != nil {
+		return nil, err
+	}
+
+	if s.verifyRetriedStates, err = parseBool(storeConfig, "verify_retried_states"); err != nil {
+		return nil, err
+	}
+
+	if s.expectContinue, err = parseBool(storeConfig, "expect_continue"); err != nil {
+		return nil, err
+	}
+
+	if tx, err := parseBool(storeConfig, "transactions"); err != nil {
+		return nil, err
+	} else if tx {
+		s.tx = &transaction{}
+	}
+
+	if coalesce, err := parseBool(storeConfig, "coalesce_reads"); err != nil {
+		return nil, err
+	} else if coalesce {
+		s.flights = &flights{}
+	}
+
+	if s.eagerConnect, err = parseBool(storeConfig, "eager_connect"); err != nil {
+		return nil, err
+	}
+
+	if s.contentRange, err = parseContentRangeMode(storeConfig); err != nil {
+		return nil, err
+	}
+
+	switch value := storeConfig["short_range"]; value {
+	case "", "error":
+	case "continue":
+		s.continueShortRanges = true
+	default:
+		return nil, fmt.Errorf("invalid short_range %q: expected error or continue", value)
+	}
+
+	s.uploadContentType = "application/octet-stream"
+	if value, ok := storeConfig["upload_content_type"]; ok {
+		if _, _, err := mime.ParseMediaType(value); err != nil {
+			return nil, fmt.Errorf("invalid upload_content_type %q: %w", value, err)
+		}
+		s.uploadContentType = value
+	}
+
+	s.brotli = true
+	if _, ok := storeConfig["brotli"]; ok {
+		if s.brotli, err = parseBool(storeConfig, "brotli"); err != nil {
+			return nil, err
+		}
+	}
+	if s.uploadEncoding, err = parseUploadEncoding(storeConfig); err != nil {
+		return nil, err
+	}
+
+	if s.listIntervals, err = parseListIntervals(storeConfig); err != nil {
+		return nil, err
+	}
+
+	if cache, err := parseBool(storeConfig, "state_cache"); err != nil {
+		return nil, err
+	} else if cache {
+		s.stateCache = &stateCache{}
+	}
+
+	// set apart from max_connections, which still caps the whole store
+	if _, ok := storeConfig["batch_parallelism"]; ok {
+		if s.concurrency, err = parseCount(storeConfig, "batch_parallelism"); err != nil {
+			return nil, err
+		}
+		if s.concurrency < 1 {
+			return nil, fmt.Errorf("invalid batch_parallelism %d: must be at least 1", s.concurrency)
+		}
+	}
+
+	if s.diagnoseWrite, err = parseBool(storeConfig, "diagnose_write"); err != nil {
+		return nil, err
+	}
+
+	if n, err := parseCount(storeConfig, "body_capture"); err != nil {
+		return nil, err
+	} else if n > 0 {
+		s.captures = newCaptureRing(n)
+	}
+
+	s.listPageSize = defaultListPageSize
+	if _, ok := storeConfig["list_page_size"]; ok {
+		if s.listPageSize, err = parseCount(storeConfig, "list_page_size"); err != nil {
+			return nil, err
+		}
+		if s.listPageSize < 1 || s.listPageSize > maxListPageSize {
+			return nil, fmt.Errorf("invalid list_page_size %d: must be between 1 and %d", s.listPageSize, maxListPageSize)
+		}
+	}
+
+	if s.openTimeout, err = parseDuration(storeConfig, "open_timeout"); err != nil {
+		return nil, err
+	}
+	s.openRetry = retry
+	if _, ok := storeConfig["open_retries"]; ok {
+		if s.openRetry.maxRetries, err = parseCount(storeConfig, "open_retries"); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, op := range operations {
+		key := op + "_query"
+		value, ok := storeConfig[key]
+		if !ok {
+			continue
+		}
+		query, err := url.ParseQuery(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", key, value, err)
+		}
+		if s.opQuery == nil {
+			s.opQuery = make(map[string]url.Values)
+		}
+		s.opQuery[op] = query
+	}
+
+	if ns, ok := storeConfig["namespace"]; ok {
+		if ns == "" || ns == "." || ns == ".." || strings.ContainsAny(ns, "/\\") {
+			return nil, fmt.Errorf("invalid namespace %q", ns)
+		}
+		s.namespace = ns
+		s.namespacePath = "/namespaces/" + ns
+	}
+
+	if s.chunkedPackfiles, err = parseBool(storeConfig, "chunked_packfiles"); err != nil {
+		return nil, err
 	}
 
-	return &Store{
-		location:  location,
-		authToken: storeConfig["auth_token"],
-	}, nil
+	if s.compress, err = parseCompression(storeConfig); err != nil {
+		return nil, err
+	}
+
+	if s.apiVersions, err = parseAPIVersions(storeConfig); err != nil {
+		return nil, err
+	}
+
+	if s.createMethod, err = parseMethod(storeConfig, "create_method"); err != nil {
+		return nil, err
+	}
+	if s.updateMethod, err = parseMethod(storeConfig, "update_method"); err != nil {
+		return nil, err
+	}
+
+	if s.conditionalDelete, err = parseBool(storeConfig, "conditional_delete"); err != nil {
+		return nil, err
+	}
+
+	s.retrievalPoll = defaultRetrievalPoll
+	if _, ok := storeConfig["retrieval_poll_interval"]; ok {
+		if s.retrievalPoll, err = parseDuration(storeConfig, "retrieval_poll_interval"); err != nil {
+			return nil, err
+		}
+		if s.retrievalPoll == 0 {
+			return nil, fmt.Errorf("invalid retrieval_poll_interval: must be above zero")
+		}
+	}
+	s.retrievalMaxWait = defaultRetrievalMaxWait
+	if _, ok := storeConfig["retrieval_max_wait"]; ok {
+		if s.retrievalMaxWait, err = parseDuration(storeConfig, "retrieval_max_wait"); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.objectTTL, err = parseDuration(storeConfig, "object_ttl"); err != nil {
+		return nil, err
+	}
+
+	if s.versionMin, s.versionMax, err = parseVersionRange(storeConfig); err != nil {
+		return nil, err
+	}
+
+	if s.autoHTTPS, err = parseBool(storeConfig, "auto_https"); err != nil {
+		return nil, err
+	}
+	s.httpsPort = storeConfig["https_port"]
+
+	if endpoint, ok := storeConfig["nonce_endpoint"]; ok {
+		s.nonces = &nonces{endpoint: endpoint}
+	}
+
+	return s, nil
 }
 
 func (s *Store) Ping(ctx context.Context) error {
@@ -63,49 +574,410 @@ func (s *Store) Root() string          { return s.location.Path }
 func (s *Store) Type() string          { return "http" }
 func (s *Store) Flags() location.Flags { return 0 }
 
-func (s *Store) sendRequest(method string, requestType string, payload io.Reader, rg *storage.Range) (*http.Response, error) {
-	u := *s.location
-	u.Path = path.Join(u.Path, requestType)
-	req, err := http.NewRequest(method, u.String(), payload)
+// the operations that can be tuned one by one in the configuration
+const (
+	opOpen   = "open"
+	opList   = "list"
+	opGet    = "get"
+	opPut    = "put"
+	opPatch  = "patch"
+	opDelete = "delete"
+)
+
+var operations = []string{opOpen, opList, opGet, opPut, opPatch, opDelete}
+
+// request is one operation against the server, it may go out more than
+// once so nothing in it is consumed by sending it.
+type request struct {
+	op     string
+	method string
+	path   string
+	query  url.Values
+	body   *requestBody
+	rg     *storage.Range
+	header http.Header
+
+	// overrides the store's retry policy when set
+	retry *retryPolicy
+
+	// the body goes out gzipped
+	compress bool
+
+	// of the body, application/json when empty
+	contentType string
+
+	// how many times it was sent, set as it is
+	attempts int
+}
+
+// sendRequest sends rq, retrying it as the policy allows.  The request
+// is tied to the store as well as to ctx, closing the store aborts it
+// along with the reading of its response.
+func (s *Store) sendRequest(ctx context.Context, rq *request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(s.ctx, func() { cancel(errStoreClosed) })
+	release := func() {
+		stop()
+		cancel(nil)
+	}
+
+	var c *capture
+	if s.captures != nil {
+		c = &capture{time: s.clock.Now(), method: rq.method, path: rq.path}
+		if rq.body != nil {
+			c.request = &snippet{}
+			rq.body.capture = c.request
+		}
+		defer s.captures.add(c)
+	}
+
+	r, err := s.sendRetrying(ctx, rq)
 	if err != nil {
+		release()
+		if cause := context.Cause(ctx); errors.Is(cause, errStoreClosed) {
+			err = cause
+		}
+		if c != nil {
+			c.err = err.Error()
+		}
 		return nil, err
 	}
+	body := &releasingBody{ReadCloser: r.Body, release: release}
+	if c != nil {
+		c.status = r.StatusCode
+		c.response = &snippet{}
+		r.Body = &capturingBody{releasingBody: body, sn: c.response}
+	} else {
+		r.Body = body
+	}
+	return r, nil
+}
+
+func (s *Store) sendRetrying(ctx context.Context, rq *request) (*http.Response, error) {
+	retry := &s.retry
+	if rq.retry != nil {
+		retry = rq.retry
+	}
+
+	waited := false
+	for attempt := 0; ; attempt++ {
+		rq.attempts++
+		r, err := s.attempt(ctx, rq)
+
+		// a maintenance is waited out once, in full, rather than
+		// hammered through the usual backoff.
+		if r != nil {
+			if window, ok := s.maintenanceWindow(r); ok {
+				discard(r)
+				if waited || window == 0 || window > maxMaintenanceWait || rq.body.rewind() != nil {
+					return nil, maintenanceError(window)
+				}
+				waited = true
+				s.logger.Warn("server in maintenance, waiting", "path", rq.path, "window", window)
+				if err := sleepContext(ctx, s.clock, window); err != nil {
+					return nil, err
+				}
+				attempt--
+				continue
+			}
+		}
+
+		if attempt >= retry.maxRetries || !retry.retryable(ctx, r, err) {
+			return r, err
+		}
+		if rq.body.rewind() != nil {
+			return r, err
+		}
+		reason := retryReason(r, err)
+		if r != nil {
+			discard(r)
+		}
+		s.stats.retries.Add(1)
 
-	req.Header.Set("Content-Type", "application/json")
+		delay := retry.backoff(attempt, &s.jitter)
+		s.logRetry(ctx, retry, rq, attempt+1, reason, delay)
+		if err := sleepContext(ctx, s.clock, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *Store) attempt(ctx context.Context, rq *request) (*http.Response, error) {
+	if s.nonces != nil && rq.mutating() && s.nonces.get() == "" {
+		if err := s.refreshNonce(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if s.tx != nil && rq.mutating() && rq.op != opTransaction {
+		if _, err := s.beginTransaction(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := s.roundTrip(ctx, rq)
+	if err != nil && s.shouldUpgrade(err) && rq.body.rewind() == nil {
+		s.upgradeTo(s.httpsHost())
+		r, err = s.roundTrip(ctx, rq)
+	}
+	if err != nil && uploadCutOff(rq, err) {
+		if rq.header.Get("Expect") != "" || rq.body.rewind() != nil {
+			return nil, uploadCutOffError(rq, err)
+		}
+		// have the server say what it has against the upload before
+		// the body goes out this time.
+		again := withExpectContinue(rq)
+		if r, err = s.roundTrip(ctx, again); err != nil && uploadCutOff(again, err) {
+			return nil, uploadCutOffError(again, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// a server that can't take the compressed body gets it as is,
+	// and keeps getting it as is.  What this attempt sent is in its
+	// headers, another upload may have stopped the compression since.
+	compressed := rq.compress && r.Request.Header.Get("Content-Encoding") != ""
+	if r.StatusCode == http.StatusUnsupportedMediaType && compressed && rq.body.rewind() == nil {
+		discard(r)
+		if !s.encodingRejected.Swap(true) {
+			s.logger.Warn("server rejected a compressed upload, no longer compressing", "encoding", s.uploadEncoding)
+		}
+		if r, err = s.roundTrip(ctx, rq); err != nil {
+			return nil, err
+		}
+	}
+
+	// servers that want to be asked get asked, once
+	if r.StatusCode == http.StatusUnauthorized {
+		if auth := s.answerChallenge(r); auth != "" && rq.body.rewind() == nil {
+			discard(r)
+
+			authed := *rq
+			authed.header = rq.header.Clone()
+			if authed.header == nil {
+				authed.header = make(http.Header)
+			}
+			authed.header.Set("Authorization", auth)
+			if r, err = s.roundTrip(ctx, &authed); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// plain http goes through the proxy request by request, answer
+	// its Negotiate challenge once.
+	if r.StatusCode == http.StatusProxyAuthRequired && s.negotiate != nil {
+		if challenge, ok := negotiateChallenge(r); ok && rq.body.rewind() == nil {
+			u := s.baseURL()
+			proxy := proxyFor(s.transport, &u)
+			if proxy == nil {
+				return r, nil
+			}
+			token, err := s.negotiate.Token(ctx, proxy, challenge)
+			if err != nil {
+				r.Body.Close()
+				return nil, err
+			}
+			discard(r)
+
+			authed := *rq
+			authed.header = rq.header.Clone()
+			if authed.header == nil {
+				authed.header = make(http.Header)
+			}
+			authed.header.Set("Proxy-Authorization", negotiateHeader(token))
+			if r, err = s.roundTrip(ctx, &authed); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// an expired nonce gets one fresh try
+	if r.StatusCode == statusNonceExpired && s.nonces != nil && rq.mutating() {
+		if err := rq.body.rewind(); err != nil {
+			return r, nil
+		}
+		r.Body.Close()
+		s.nonces.reset()
+		if err := s.refreshNonce(ctx); err != nil {
+			return nil, err
+		}
+		return s.roundTrip(ctx, rq)
+	}
+
+	return r, nil
+}
+
+func (s *Store) roundTrip(ctx context.Context, rq *request) (*http.Response, error) {
+	u := s.baseURL()
+	u.Path = path.Join(u.Path, s.apiPath(), s.namespacePath, rq.path)
+
+	// the location's own query comes first, then the one set for the
+	// operation, then what the request itself needs.
+	if opQuery := s.opQuery[rq.op]; len(opQuery) != 0 || len(rq.query) != 0 {
+		q := u.Query()
+		for k, v := range opQuery {
+			q[k] = v
+		}
+		for k, v := range rq.query {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	// read once, a concurrent refusal mustn't leave the body
+	// compressed and its headers saying otherwise
+	compress := s.compressing(rq)
+	var payload io.Reader
+	var trailer http.Header
+	if rq.body != nil {
+		payload = rq.body.attempt()
+		var zr io.ReadCloser
+		if compress {
+			zr = compressReader(payload, s.uploadEncoding)
+			payload = zr
+		}
+		payload = &meteredReader{
+			rd: s.uploadLimiter.reader(ctx, payload),
+			n:  &s.stats.uploaded,
+		}
+		// a chunked upload whose digest wasn't known up front gets it
+		// as a trailer
+		chunked := compress || rq.body.size < 0
+		if chunked && rq.body.h != nil && rq.header.Get(s.integrity.header) == "" {
+			trailer = http.Header{s.integrity.header: nil}
+			payload = &digestTrailer{rd: payload, body: rq.body, trailer: trailer, key: s.integrity.header}
+		}
+		payload = &copyBuffer{rd: payload, size: s.uploadChunkSize, closer: zr}
+	}
+
+	req, err := http.NewRequestWithContext(s.traceConns(ctx), rq.method, u.String(), payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Trailer = trailer
+
+	// requests without a payload go out bare, strict servers reject
+	// a GET with a body or a Content-Type.  The length is advertised
+	// when known, otherwise the body goes out chunked.
+	if rq.body != nil {
+		contentType := rq.contentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+		if compress {
+			req.Header.Set("Content-Encoding", s.uploadEncoding)
+		} else if rq.body.size >= 0 {
+			req.ContentLength = rq.body.size
+			if rq.body.size == 0 {
+				req.Body = http.NoBody
+			}
+		}
+	}
+
+	s.applyContextHeaders(ctx, req.Header)
 	if s.authToken != "" {
 		req.Header.Set("Authorization", "Bearer "+s.authToken)
 	}
-	if rg != nil {
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rg.Offset, rg.Offset+uint64(rg.Length)))
+	for k, v := range rq.header {
+		req.Header[k] = v
+	}
+	if rq.rg != nil {
+		// a range of compressed bytes is of no use, ask for the
+		// object as stored.
+		req.Header.Set("Range", rangeHeader(rq.rg))
+		req.Header.Set("Accept-Encoding", "identity")
+	} else if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding(s.brotli))
+	}
+	if s.nonces != nil && rq.mutating() {
+		req.Header.Set(nonceHeader, s.nonces.get())
+	}
+	if s.namespace != "" {
+		req.Header.Set(namespaceHeader, s.namespace)
+	}
+	if rq.mutating() && rq.op != opTransaction {
+		if id := s.transactionID(); id != "" {
+			req.Header.Set(transactionHeader, id)
+		}
 	}
 
-	return http.DefaultClient.Do(req)
-}
+	s.stats.requests.Add(1)
+	r, err := s.client.Do(req)
+	s.stats.recordError(errorClass(r, err))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = &meteredReadCloser{
+		meteredReader: meteredReader{rd: r.Body, n: &s.stats.downloaded},
+		Closer:        r.Body,
+	}
 
-func (s *Store) Create(ctx context.Context, config []byte) error {
-	return nil
+	if s.nonces != nil {
+		s.nonces.update(r)
+	}
+	s.noteServerVersion(r)
+
+	// responses are decoded as they are read, make sure it doesn't go
+	// on forever.  An encoded range is left for get to refuse, it is a
+	// slice of the compressed stream.
+	if rq.rg == nil {
+		decodeResponse(r)
+	}
+	if r.Uncompressed && s.maxDecompressedSize > 0 {
+		r.Body = &limitedBody{rc: r.Body, limit: s.maxDecompressedSize}
+	}
+	return r, nil
 }
 
-func (s *Store) Open(ctx context.Context) ([]byte, error) {
-	r, err := s.sendRequest("GET", "/", nil, nil)
+func (s *Store) refreshNonce(ctx context.Context) error {
+	r, err := s.roundTrip(ctx, &request{method: "GET", path: s.nonces.endpoint})
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer r.Body.Close()
 
 	if r.StatusCode != 200 {
-		errmsg, err := io.ReadAll(r.Body)
-		if err != nil {
+		return s.statusError(r)
+	}
+	if s.nonces.get() == "" {
+		return fmt.Errorf("no nonce in %s response", s.nonces.endpoint)
+	}
+	return nil
+}
+
+func (s *Store) Create(ctx context.Context, config []byte) error {
+	return nil
+}
+
+// Open is the first request made to the server, it gets its own timeout
+// and retries so that a server slow to come up doesn't fail the whole
+// session.
+func (s *Store) Open(ctx context.Context) ([]byte, error) {
+	s.stats.reset()
+
+	if s.openTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.openTimeout)
+		defer cancel()
+	}
+	if s.apiVersions != nil {
+		if err := s.negotiateAPIVersion(ctx); err != nil {
 			return nil, err
 		}
-		return nil, fmt.Errorf("%s", errmsg)
 	}
-
-	return io.ReadAll(r.Body)
+	return doRequest[[]byte](ctx, s, &request{op: opOpen, method: "GET", path: "/", retry: &s.openRetry})
 }
 
 func (s *Store) Close(ctx context.Context) error {
-	return nil
+	err := s.endTransaction(ctx, true)
+	s.cancel()
+	if !s.sharedPool {
+		s.transport.CloseIdleConnections()
+	}
+	return err
 }
 
 func (s *Store) Mode(ctx context.Context) (storage.Mode, error) {
@@ -116,84 +988,481 @@ func (s *Store) Size(ctx context.Context) (int64, error) {
 	return -1, nil
 }
 
+// List walks the listing a page at a time, following the cursor the
+// server hands back until there is none.  Servers that do not paginate
+// ignore the limit and send everything at once.
 func (s *Store) List(ctx context.Context, res storage.StorageResource) ([]objects.MAC, error) {
-	uri := "/resources/" + strres(res)
-	r, err := s.sendRequest("GET", uri, nil, nil)
-	if err != nil {
-		return nil, err
+	if d := s.listIntervals[res]; d != nil {
+		return d.get(ctx, s.clock, func(ctx context.Context) ([]objects.MAC, error) {
+			return s.list(ctx, res)
+		})
 	}
+	return s.list(ctx, res)
+}
 
-	if r.StatusCode != 200 {
-		errmsg, err := io.ReadAll(r.Body)
+func (s *Store) list(ctx context.Context, res storage.StorageResource) ([]objects.MAC, error) {
+	ret, _, err := s.listSince(ctx, res, "")
+	return ret, err
+}
+
+// listSince lists what was added after watermark, everything if empty,
+// and returns the watermark of the first page, "" if the server sent
+// none.
+func (s *Store) listSince(ctx context.Context, res storage.StorageResource, watermark string) ([]objects.MAC, string, error) {
+	var ret []objects.MAC
+	var next string
+	cursor := ""
+	for {
+		query := url.Values{"limit": {strconv.Itoa(s.listPageSize)}}
+		if watermark != "" {
+			query.Set("since", watermark)
+		}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		page, header, err := s.listPage(ctx, res, query)
 		if err != nil {
-			return nil, err
+			return nil, "", err
+		}
+		if cursor == "" {
+			next = header.Get(watermarkHeader)
+		}
+		cursor = header.Get(cursorHeader)
+		if s.createMethod != s.updateMethod {
+			for _, mac := range page {
+				s.existing.set(res, mac, true)
+			}
+		}
+		ret = append(ret, page...)
+		if cursor == "" {
+			return ret, next, nil
 		}
-		return nil, fmt.Errorf("%s", errmsg)
 	}
+}
 
-	var ret []objects.MAC
-	if err := json.NewDecoder(r.Body).Decode(&ret); err != nil {
-		return nil, err
-	} else {
-		return ret, nil
-	}
+func (s *Store) listPage(ctx context.Context, res storage.StorageResource, query url.Values) ([]objects.MAC, http.Header, error) {
+	rq := &request{op: opList, method: "GET", path: "/resources/" + strres(res), query: query}
+	return doRequestHeader[[]objects.MAC](ctx, s, rq)
+}
+
+// PutOptions tune a single upload, the zero value uses the store
+// defaults.
+type PutOptions struct {
+	// TTL asks the server to expire the object after that long, it
+	// only applies to packfiles and states.
+	TTL time.Duration
+
+	// StorageClass is a tiering hint for packfiles, such as "cold",
+	// that servers without tiers ignore.
+	StorageClass string
+
+	// IfMatch makes the upload conditional on the object having that
+	// ETag, "*" for any, ErrPreconditionFailed otherwise.
+	IfMatch string
+
+	// IfNoneMatch "*" makes the upload conditional on the object not
+	// existing yet.
+	IfNoneMatch string
+
+	// Size is the length of a reader that can't tell it, so that the
+	// upload goes out with a Content-Length rather than chunked, and
+	// so without the digest trailer.  The upload fails if the reader
+	// doesn't bring exactly that much.
+	Size int64
 }
 
 func (s *Store) Put(ctx context.Context, res storage.StorageResource, mac objects.MAC, rd io.Reader) (int64, error) {
+	return s.PutWithOptions(ctx, res, mac, rd, PutOptions{})
+}
+
+func (s *Store) PutWithOptions(ctx context.Context, res storage.StorageResource, mac objects.MAC, rd io.Reader, opts PutOptions) (n int64, err error) {
+	defer func() { s.audit(opPut, res, mac, n, err) }()
+
 	uri := fmt.Sprintf("/resources/%s/%016x", strres(res), mac)
-	cr := &countingReader{rc: rd}
-	r, err := s.sendRequest("PUT", uri, cr, nil)
+	// one key per upload, its retries reuse the header and so the key
+	header := http.Header{idempotencyHeader: {uuid.NewString()}}
+
+	if res == storage.StorageResourcePackfile || res == storage.StorageResourceState {
+		ttl := opts.TTL
+		if ttl == 0 {
+			ttl = s.objectTTL
+		}
+		// rounded up, a TTL under a second must not read as 0
+		if ttl > 0 {
+			header.Set(ttlHeader, strconv.FormatInt(int64((ttl+time.Second-1)/time.Second), 10))
+		}
+	}
+	if res == storage.StorageResourcePackfile {
+		class := opts.StorageClass
+		if class == "" {
+			class = s.storageClass
+		}
+		if class != "" {
+			header.Set(storageClassHeader, class)
+		}
+	}
+
+	if opts.IfMatch != "" {
+		header.Set("If-Match", opts.IfMatch)
+	}
+	if opts.IfNoneMatch != "" {
+		header.Set("If-None-Match", opts.IfNoneMatch)
+	}
+	if s.expectContinue && res == storage.StorageResourcePackfile {
+		header.Set("Expect", "100-continue")
+	}
+
+	// the digest goes in a header when it can be read up front, as a
+	// trailer of a chunked upload otherwise.
+	body := newRequestBody(rd, s.integrity.new())
+	if body.size < 0 && opts.Size > 0 {
+		body.size = opts.Size
+	}
+	if sum, ok, err := body.digest(s.integrity.new()); err != nil {
+		return -1, err
+	} else if ok {
+		header.Set(s.integrity.header, hex.EncodeToString(sum))
+	}
+	rq := &request{
+		op:       opPut,
+		method:   s.putMethod(res, mac),
+		path:     uri,
+		body:     body,
+		header:   header,
+		compress: s.compress[res],
+
+		contentType: s.uploadContentType,
+	}
+	r, err := s.sendRequest(ctx, rq)
 	if err != nil {
 		return -1, err
 	}
-	defer r.Body.Close()
 
-	if r.StatusCode != 200 {
-		errmsg, err := io.ReadAll(r.Body)
-		if err != nil {
+	// the object only turned out to exist, overwrite it
+	if r.StatusCode == http.StatusConflict && r.Header.Get(s.integrity.header) == "" &&
+		rq.method != s.updateMethod && body.rewind() == nil {
+		r.Body.Close()
+		rq.method = s.updateMethod
+		rq.header.Set(idempotencyHeader, uuid.NewString())
+		if r, err = s.sendRequest(ctx, rq); err != nil {
 			return -1, err
 		}
-		return -1, fmt.Errorf("%s", errmsg)
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+	case http.StatusConflict:
+		return s.putConflict(r, body)
+	case http.StatusPreconditionFailed:
+		return -1, fmt.Errorf("%w: %s %016x", ErrPreconditionFailed, strres(res), mac)
+	default:
+		return -1, s.statusError(r)
 	}
 
-	return cr.n, nil
+	s.etags.set(res, mac, r.Header.Get("ETag"))
+	if s.createMethod != s.updateMethod {
+		s.existing.set(res, mac, true)
+	}
+	s.listIntervals[res].invalidate()
+	s.stateCache.forget(res, mac)
+	s.prefetch.forget(res, mac)
+
+	if rq.attempts > 1 && s.verifyRetriedStates && res == storage.StorageResourceState {
+		if err := s.verifyWrite(ctx, uri, body); err != nil {
+			return -1, err
+		}
+	}
+	return body.count(), nil
 }
 
+// Get fetches an object, or a range of it.  Ranged reads of an object
+// whose ETag is known are sent with If-Range: the server then answers
+// with the whole object if it changed, and the range is cut out of it
+// here, so that a read is never stitched from two versions.  The same
+// goes for a server ignoring Range altogether.
 func (s *Store) Get(ctx context.Context, res storage.StorageResource, mac objects.MAC, rg *storage.Range) (io.ReadCloser, error) {
+	// there is no Range header for nothing
+	if rg != nil && rg.Length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if rg != nil && res == storage.StorageResourcePackfile && s.prefetch != nil {
+		defer s.prefetch.schedule(s, mac, rg.Offset+uint64(rg.Length))
+		if data, ok := s.prefetch.lookup(ctx, mac, rg); ok {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+
+	if s.flights != nil {
+		return s.getShared(ctx, res, mac, rg)
+	}
+	return s.getOne(ctx, res, mac, rg)
+}
+
+func (s *Store) getOne(ctx context.Context, res storage.StorageResource, mac objects.MAC, rg *storage.Range) (io.ReadCloser, error) {
+	rc, err := s.get(ctx, res, mac, rg)
+	if err != nil || rg == nil {
+		return rc, err
+	}
+	return &shortRangeBody{ctx: ctx, s: s, res: res, mac: mac, rg: *rg, rc: rc}, nil
+}
+
+func (s *Store) get(ctx context.Context, res storage.StorageResource, mac objects.MAC, rg *storage.Range) (io.ReadCloser, error) {
+	if rg == nil && res == storage.StorageResourceState && s.stateCache != nil {
+		return s.getCachedState(ctx, mac)
+	}
+
 	uri := fmt.Sprintf("/resources/%s/%016x", strres(res), mac)
-	r, err := s.sendRequest("GET", uri, nil, rg)
+	rq := &request{op: opGet, method: "GET", path: uri, rg: rg}
+
+	ifRange := ""
+	if rg != nil {
+		if ifRange = s.etags.get(res, mac); ifRange != "" {
+			rq.header = http.Header{"If-Range": {ifRange}}
+		}
+	}
+
+	if rg == nil && res == storage.StorageResourcePackfile && s.chunkedPackfiles {
+		rc, ok, err := s.getChunked(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return rc, nil
+		}
+	}
+
+	r, err := s.sendRetrieving(withObjectFetch(ctx), rq)
 	if err != nil {
 		return nil, err
 	}
 
-	if r.StatusCode != 200 {
-		errmsg, err := io.ReadAll(r.Body)
-		if err != nil {
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusPartialContent {
+		defer r.Body.Close()
+		return nil, s.statusError(r)
+	}
+	clamped := int64(-1)
+	if rg != nil {
+		if enc := r.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+			r.Body.Close()
+			return nil, fmt.Errorf("server sent a %s encoded range, which can't be sliced", enc)
+		}
+		if clamped, err = s.checkContentRange(r, rg); err != nil {
+			r.Body.Close()
+			return nil, err
+		}
+	}
+	s.etags.set(res, mac, r.Header.Get("ETag"))
+
+	body := r.Body
+	if rg == nil && s.verifyTrailerDigest && announcesTrailer(r, s.integrity.header) {
+		body = newTrailerDigestBody(r, s.integrity)
+	}
+	if rg != nil && r.StatusCode == http.StatusOK {
+		if body, err = newSliceBody(body, rg); err != nil {
 			return nil, err
 		}
-		return nil, fmt.Errorf("%s", errmsg)
 	}
-	return r.Body, nil
+	body = s.downloadLimiter.readCloser(ctx, body)
+	if clamped >= 0 {
+		return &clampedBody{ReadCloser: body, length: clamped}, nil
+	}
+	return body, nil
 }
 
+// Delete names the object in the path alone, the request carries no
+// body, which strict servers refuse on a DELETE.
 func (s *Store) Delete(ctx context.Context, res storage.StorageResource, mac objects.MAC) error {
 	uri := fmt.Sprintf("/resources/%s/%016x", strres(res), mac)
-	r, err := s.sendRequest("DELETE", uri, nil, nil)
+	rq := &request{op: opDelete, method: "DELETE", path: uri}
+
+	// a packfile replaced since it was last seen is left alone
+	if s.conditionalDelete && res == storage.StorageResourcePackfile {
+		if etag := s.etags.get(res, mac); etag != "" {
+			rq.header = http.Header{"If-Match": {etag}}
+		}
+	}
+
+	_, err := doRequest[struct{}](ctx, s, rq)
+	if se, ok := err.(*statusErr); ok && se.status == http.StatusPreconditionFailed {
+		err = fmt.Errorf("%w: packfile %016x", ErrPreconditionFailed, mac)
+	}
+	if err == nil {
+		s.etags.set(res, mac, "")
+		s.existing.set(res, mac, false)
+		s.listIntervals[res].invalidate()
+		s.stateCache.forget(res, mac)
+		s.prefetch.forget(res, mac)
+	}
+	s.audit(opDelete, res, mac, -1, err)
+	return err
+}
+
+// releasingBody lets go of the request context once the response has
+// been read.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// doRequest is the round-trip shared by the operations that get a
+// whole reply back: it sends the request, checks the status and
+// decodes the body into a Res.  A []byte is handed out as is and a
+// struct{} means the body is not looked at.
+func doRequest[Res any](ctx context.Context, s *Store, rq *request) (Res, error) {
+	res, _, err := doRequestHeader[Res](ctx, s, rq)
+	return res, err
+}
+
+// doRequestHeader is doRequest for the callers that need to look at the
+// response headers too.
+func doRequestHeader[Res any](ctx context.Context, s *Store, rq *request) (Res, http.Header, error) {
+	var res Res
+
+	_, raw := any(&res).(*[]byte)
+	_, none := any(&res).(*struct{})
+	decode := !raw && !none
+	if decode {
+		if rq.header == nil {
+			rq.header = make(http.Header)
+		}
+		rq.header.Set("Accept", "application/json")
+	}
+
+	r, err := s.sendRequest(ctx, rq)
 	if err != nil {
-		return err
+		return res, nil, err
 	}
 	defer r.Body.Close()
 
-	if r.StatusCode != 200 {
-		errmsg, err := io.ReadAll(r.Body)
-		if err != nil {
-			return err
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		// nothing to decode, that's a success all the same
+		return res, r.Header, nil
+	default:
+		return res, nil, s.statusError(r)
+	}
+
+	switch v := any(&res).(type) {
+	case *[]byte:
+		*v, err = io.ReadAll(r.Body)
+	case *struct{}:
+	default:
+		if s.strictContentType {
+			if err := checkContentType(r, "application/json"); err != nil {
+				return res, nil, err
+			}
+		}
+		if s.envelope {
+			err = s.decodeEnveloped(r.Body, v)
+		} else {
+			err = json.NewDecoder(r.Body).Decode(v)
 		}
-		return fmt.Errorf("%s", errmsg)
+	}
+	return res, r.Header, err
+}
+
+// checkContentType catches the proxies answering a 200 with their own
+// HTML page instead of what the server sent.
+func checkContentType(r *http.Response, want string) error {
+	ct := r.Header.Get("Content-Type")
+	mediatype, _, err := mime.ParseMediaType(ct)
+	if err != nil || mediatype != want {
+		return fmt.Errorf("unexpected content type %q in response, expected %q", ct, want)
 	}
 	return nil
 }
 
+// statusError turns an unexpected response into an error carrying
+// whatever message the server sent along.  A JSON body is searched for
+// the message in the configured error fields, servers don't agree on
+// a name.
+func (s *Store) statusError(r *http.Response) error {
+	errmsg, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if msg, ok := errorField(errmsg, s.errorFields); ok {
+		errmsg = []byte(msg)
+	}
+	return &statusErr{status: r.StatusCode, msg: string(errmsg)}
+}
+
+// errorField extracts the first non-empty field out of fields from a
+// JSON object, looking one level deeper for {"error": {"message": ...}}.
+func errorField(body []byte, fields []string) (string, bool) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return "", false
+	}
+	for _, field := range fields {
+		raw, ok := obj[field]
+		if !ok {
+			continue
+		}
+		var msg string
+		if err := json.Unmarshal(raw, &msg); err == nil {
+			if msg != "" {
+				return msg, true
+			}
+			continue
+		}
+		if msg, ok := errorField(raw, fields); ok {
+			return msg, true
+		}
+	}
+	return "", false
+}
+
+// statusErr keeps the status around for the callers that need to tell
+// errors apart, its message is just what the server said.
+type statusErr struct {
+	status int
+	msg    string
+}
+
+func (e *statusErr) Error() string {
+	return e.msg
+}
+
+// isUnsupported tells whether a status means the server does not know
+// about an optional endpoint.
+func isUnsupported(status int) bool {
+	return status == http.StatusNotFound ||
+		status == http.StatusMethodNotAllowed ||
+		status == http.StatusNotImplemented
+}
+
+// putConflict handles a 409 on upload.  Retried uploads hit this all the
+// time, so it is only an error when the digest the server reports for
+// the object it has differs from ours.
+func (s *Store) putConflict(r *http.Response, body *requestBody) (int64, error) {
+	remote := r.Header.Get(s.integrity.header)
+	if remote == "" {
+		return -1, ErrMacConflict
+	}
+
+	// the server may have answered before reading the whole body,
+	// hash what it left behind.
+	if err := body.drain(); err != nil {
+		return -1, err
+	}
+
+	if !strings.EqualFold(remote, hex.EncodeToString(body.sum())) {
+		return -1, ErrMacConflict
+	}
+	return body.count(), nil
+}
+
 // we need a stringer on that enum
 func strres(s storage.StorageResource) string {
 	switch s {
@@ -214,13 +1483,17 @@ func strres(s storage.StorageResource) string {
 	}
 }
 
-type countingReader struct {
-	rc io.Reader
-	n  int64
-}
-
-func (c *countingReader) Read(p []byte) (int, error) {
-	k, err := c.rc.Read(p)
-	c.n += int64(k)
-	return k, err
+func parseres(s string) (storage.StorageResource, bool) {
+	for _, res := range []storage.StorageResource{
+		storage.StorageResourcePackfile,
+		storage.StorageResourceState,
+		storage.StorageResourceLock,
+		storage.StorageResourceECCPackfile,
+		storage.StorageResourceECCState,
+	} {
+		if strres(res) == s {
+			return res, true
+		}
+	}
+	return storage.StorageResourceUndefined, false
 }
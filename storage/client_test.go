@@ -0,0 +1,839 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get(idempotencyHeader))
+		// the first attempt at each upload fails
+		if len(keys)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}), nil)
+
+	mac := objects.MAC{1}
+	for _, data := range []string{"first", "second"} {
+		if _, err := s.Put(context.Background(), storage.StorageResourceState, mac, bytes.NewReader([]byte(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(keys) != 4 {
+		t.Fatalf("got %d requests, want 4", len(keys))
+	}
+	if keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("retry sent key %q, first attempt %q", keys[1], keys[0])
+	}
+	if keys[2] != keys[3] {
+		t.Errorf("retry sent key %q, first attempt %q", keys[3], keys[2])
+	}
+	if keys[0] == keys[2] {
+		t.Errorf("two uploads of the same object share key %q", keys[0])
+	}
+}
+
+func TestObjectTTL(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		opt    time.Duration
+		res    storage.StorageResource
+		want   string
+	}{
+		{"72h", 0, storage.StorageResourcePackfile, "259200"},
+		{"500ms", 0, storage.StorageResourceState, "1"},
+		{"1500ms", 0, storage.StorageResourceState, "2"},
+		{"72h", time.Hour, storage.StorageResourceState, "3600"},
+		{"72h", 0, storage.StorageResourceLock, ""},
+		{"", 0, storage.StorageResourcePackfile, ""},
+	} {
+		var got string
+		config := map[string]string{}
+		if test.config != "" {
+			config["object_ttl"] = test.config
+		}
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			got = r.Header.Get(ttlHeader)
+		}), config)
+
+		opts := PutOptions{TTL: test.opt}
+		if _, err := s.PutWithOptions(context.Background(), test.res, objects.MAC{1}, bytes.NewReader([]byte("data")), opts); err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("object_ttl %q, option %s, %s: sent %q, want %q", test.config, test.opt, strres(test.res), got, test.want)
+		}
+	}
+}
+
+func TestPutSize(t *testing.T) {
+	var length int64
+	var encoding []string
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		length, encoding = r.ContentLength, r.TransferEncoding
+	}), nil)
+
+	// a plain reader, its length can't be worked out
+	rd := io.MultiReader(strings.NewReader("some "), strings.NewReader("data"))
+	if _, err := s.PutWithOptions(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, rd, PutOptions{Size: 9}); err != nil {
+		t.Fatal(err)
+	}
+	if length != 9 || len(encoding) != 0 {
+		t.Errorf("sent with Content-Length %d, Transfer-Encoding %q, want a length of 9", length, encoding)
+	}
+
+	rd = io.MultiReader(strings.NewReader("short"))
+	if _, err := s.PutWithOptions(context.Background(), storage.StorageResourcePackfile, objects.MAC{2}, rd, PutOptions{Size: 9}); err == nil {
+		t.Error("a reader shorter than its size got no error")
+	}
+}
+
+// conflictServer refuses to overwrite objects, answering 409 with the
+// digest of what it holds unless noDigest.
+type conflictServer struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	noDigest bool
+}
+
+func (c *conflictServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.objects == nil {
+		c.objects = make(map[string][]byte)
+	}
+	data, _ := io.ReadAll(r.Body)
+	if old, ok := c.objects[r.URL.Path]; ok {
+		if !c.noDigest {
+			sum := sha256.Sum256(old)
+			w.Header().Set("X-Content-Sha256", hex.EncodeToString(sum[:]))
+		}
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	c.objects[r.URL.Path] = data
+}
+
+func TestPutDuplicate(t *testing.T) {
+	s, _ := newTestStore(t, &conflictServer{}, nil)
+	put := func(data string) (int64, error) {
+		return s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader([]byte(data)))
+	}
+
+	if _, err := put("packfile"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := put("packfile"); err != nil || n != 8 {
+		t.Errorf("re-upload of the same packfile: %d, %v, want 8 bytes accepted", n, err)
+	}
+	if _, err := put("another packfile"); !errors.Is(err, ErrMacConflict) {
+		t.Errorf("upload of different content: got %v, want ErrMacConflict", err)
+	}
+}
+
+func TestPutDuplicateNoDigest(t *testing.T) {
+	s, _ := newTestStore(t, &conflictServer{noDigest: true}, nil)
+	for i, want := range []error{nil, ErrMacConflict} {
+		_, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader([]byte("packfile")))
+		if !errors.Is(err, want) {
+			t.Errorf("upload %d: got %v, want %v", i+1, err, want)
+		}
+	}
+}
+
+// memServer is an in-memory implementation of the protocol, the
+// reference the store's operations are checked against.
+type memServer struct {
+	mu      sync.Mutex
+	config  []byte
+	objects map[string][]byte
+}
+
+func (m *memServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.objects == nil {
+		m.objects = make(map[string][]byte)
+	}
+	data, _ := io.ReadAll(r.Body)
+
+	if r.URL.Path == "/" {
+		w.Write(m.config)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/resources/"), "/")
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		macs := []objects.MAC{}
+		for path := range m.objects {
+			res, id, _ := strings.Cut(strings.TrimPrefix(path, "/resources/"), "/")
+			if res != parts[0] {
+				continue
+			}
+			var mac objects.MAC
+			b, _ := hex.DecodeString(id)
+			copy(mac[:], b)
+			macs = append(macs, mac)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(macs)
+	case len(parts) != 2:
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet:
+		obj, ok := m.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(obj)
+	case r.Method == http.MethodPut:
+		m.objects[r.URL.Path] = data
+	case r.Method == http.MethodDelete:
+		if _, ok := m.objects[r.URL.Path]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(m.objects, r.URL.Path)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestOperations(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, &memServer{config: []byte("repository config")}, nil)
+
+	config, err := s.Open(ctx)
+	if err != nil || string(config) != "repository config" {
+		t.Fatalf("Open: %q, %v", config, err)
+	}
+
+	for _, res := range []storage.StorageResource{storage.StorageResourcePackfile, storage.StorageResourceState, storage.StorageResourceLock} {
+		macs, err := s.List(ctx, res)
+		if err != nil || len(macs) != 0 {
+			t.Fatalf("List %s of an empty repository: %v, %v", strres(res), macs, err)
+		}
+
+		if n, err := s.Put(ctx, res, objects.MAC{1}, bytes.NewReader([]byte("object one"))); err != nil || n != 10 {
+			t.Fatalf("Put %s: %d, %v", strres(res), n, err)
+		}
+		if _, err := s.Put(ctx, res, objects.MAC{2}, bytes.NewReader([]byte("object two"))); err != nil {
+			t.Fatal(err)
+		}
+
+		macs, err = s.List(ctx, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.SortFunc(macs, func(a, b objects.MAC) int { return bytes.Compare(a[:], b[:]) })
+		if !slices.Equal(macs, []objects.MAC{{1}, {2}}) {
+			t.Errorf("List %s: %x, want the two objects put", strres(res), macs)
+		}
+
+		rd, err := s.Get(ctx, res, objects.MAC{2}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil || string(data) != "object two" {
+			t.Errorf("Get %s: %q, %v", strres(res), data, err)
+		}
+
+		if err := s.Delete(ctx, res, objects.MAC{1}); err != nil {
+			t.Fatal(err)
+		}
+		if macs, err := s.List(ctx, res); err != nil || !slices.Equal(macs, []objects.MAC{{2}}) {
+			t.Errorf("List %s after Delete: %x, %v", strres(res), macs, err)
+		}
+	}
+}
+
+func TestOperationsErrors(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, &memServer{}, map[string]string{"max_retries": "0"})
+
+	if _, err := s.Get(ctx, storage.StorageResourcePackfile, objects.MAC{1}, nil); err == nil {
+		t.Error("Get of a missing packfile succeeded")
+	}
+	var se *statusErr
+	if err := s.Delete(ctx, storage.StorageResourcePackfile, objects.MAC{1}); !errors.As(err, &se) || se.status != http.StatusNotFound {
+		t.Errorf("Delete of a missing packfile: got %v, want a 404", err)
+	}
+}
+
+func TestNoBodyOnReads(t *testing.T) {
+	var mu sync.Mutex
+	var errs []string
+	mem := &memServer{}
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodDelete {
+			mu.Lock()
+			if r.ContentLength != 0 || len(r.TransferEncoding) != 0 || r.Header.Get("Content-Type") != "" {
+				errs = append(errs, r.Method+" "+r.URL.Path+" came with a body")
+			}
+			mu.Unlock()
+		}
+		mem.ServeHTTP(w, r)
+	}), nil)
+	ctx := context.Background()
+
+	if _, err := s.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("state"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.List(ctx, storage.StorageResourceState); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := s.Get(ctx, storage.StorageResourceState, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	if err := s.Delete(ctx, storage.StorageResourceState, objects.MAC{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range errs {
+		t.Error(e)
+	}
+}
+
+func TestStrictContentType(t *testing.T) {
+	for _, test := range []struct {
+		ct     string
+		strict bool
+		ok     bool
+	}{
+		{"application/json", true, true},
+		{"application/json; charset=utf-8", true, true},
+		{"text/html", true, false},
+		{"", true, false},
+		{"text/html", false, true},
+	} {
+		var accept string
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			accept = r.Header.Get("Accept")
+			w.Header().Set("Content-Type", test.ct)
+			w.Write([]byte("[]"))
+		}), map[string]string{"strict_content_type": strconv.FormatBool(test.strict), "max_retries": "0"})
+
+		_, err := s.List(context.Background(), storage.StorageResourcePackfile)
+		if test.ok && err != nil {
+			t.Errorf("%q, strict %v: %v", test.ct, test.strict, err)
+		} else if !test.ok && (err == nil || !strings.Contains(err.Error(), "unexpected content type")) {
+			t.Errorf("%q, strict %v: got %v, want a content type error", test.ct, test.strict, err)
+		}
+		if accept != "application/json" {
+			t.Errorf("sent Accept %q, want application/json", accept)
+		}
+	}
+}
+
+// pagedServer lists n packfiles a page at a time, the cursor being the
+// index of the next entry.
+func pagedServer(n int, limits *[]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*limits = append(*limits, r.URL.Query().Get("limit"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		from, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		to := min(from+limit, n)
+		if to < n {
+			w.Header().Set(cursorHeader, strconv.Itoa(to))
+		}
+		page := []objects.MAC{}
+		for i := from; i < to; i++ {
+			page = append(page, objects.MAC{byte(i)})
+		}
+		json.NewEncoder(w).Encode(page)
+	})
+}
+
+func TestListPageSize(t *testing.T) {
+	var limits []string
+	s, _ := newTestStore(t, pagedServer(25, &limits), map[string]string{"list_page_size": "10"})
+
+	macs, err := s.List(context.Background(), storage.StorageResourcePackfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(macs) != 25 {
+		t.Fatalf("listed %d packfiles, want 25", len(macs))
+	}
+	for i, mac := range macs {
+		if mac != (objects.MAC{byte(i)}) {
+			t.Fatalf("entry %d is %x", i, mac)
+		}
+	}
+	if !slices.Equal(limits, []string{"10", "10", "10"}) {
+		t.Errorf("asked for pages of %q, want 3 pages of 10", limits)
+	}
+}
+
+func TestListPageSizeInvalid(t *testing.T) {
+	for _, size := range []string{"0", "-1", "100001", "ten"} {
+		if _, err := newStore(map[string]string{"location": "http://example.com", "list_page_size": size}); err == nil {
+			t.Errorf("list_page_size %s accepted", size)
+		}
+	}
+}
+
+func TestOpenRetries(t *testing.T) {
+	var hits atomic.Int32
+	s, _ := newTestStore(t, failingHandler(http.StatusServiceUnavailable, 2, &hits),
+		map[string]string{"open_retries": "3", "max_retries": "0"})
+
+	if _, err := s.Open(context.Background()); err != nil {
+		t.Fatalf("Open of a server coming up: %v", err)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("Open reached the server %d times, want 3", n)
+	}
+
+	hits.Store(0)
+	if _, err := s.List(context.Background(), storage.StorageResourceState); err == nil {
+		t.Error("List retried with open_retries")
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("List reached the server %d times, want 1", n)
+	}
+}
+
+func TestOpenTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			<-stall
+		}
+		w.Write([]byte("[]"))
+	}), map[string]string{"open_timeout": "50ms"})
+	t.Cleanup(func() { close(stall) })
+
+	if _, err := s.Open(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Open of a stalled server: got %v, want a timeout", err)
+	}
+	// the rest of the session isn't bound by it
+	if _, err := s.List(context.Background(), storage.StorageResourceState); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOperationQuery(t *testing.T) {
+	var mu sync.Mutex
+	queries := map[string]string{}
+	mem := &memServer{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries[r.Method+" "+path.Dir(r.URL.Path)] = r.URL.RawQuery
+		mu.Unlock()
+		mem.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	s, err := newStore(map[string]string{
+		"location":   srv.URL + "?param.tenant=acme",
+		"get_query":  "region=eu",
+		"list_query": "region=us&fast=1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close(context.Background()) })
+	ctx := context.Background()
+
+	if _, err := s.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader([]byte("packfile"))); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := s.Get(ctx, storage.StorageResourcePackfile, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	if _, err := s.List(ctx, storage.StorageResourcePackfile); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"GET /":                    "tenant=acme",
+		"PUT /resources/packfiles": "tenant=acme",
+		"GET /resources/packfiles": "region=eu&tenant=acme",
+		"GET /resources":           "fast=1&limit=1000&region=us&tenant=acme",
+	}
+	if !maps.Equal(queries, want) {
+		t.Errorf("got queries %v, want %v", queries, want)
+	}
+}
+
+func TestCloseCancelsRequests(t *testing.T) {
+	arrived := make(chan string, 3)
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server only notices the client going away once the
+		// request is read
+		io.Copy(io.Discard, r.Body)
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/packfiles/") {
+			// headers out, then the body stalls
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+		}
+		arrived <- r.Method + " " + path.Base(path.Dir(r.URL.Path))
+		<-r.Context().Done()
+	}), nil)
+	ctx := context.Background()
+
+	rd, err := s.Get(ctx, storage.StorageResourcePackfile, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+
+	errs := make(chan error, 3)
+	go func() {
+		_, err := s.Put(ctx, storage.StorageResourcePackfile, objects.MAC{2}, bytes.NewReader([]byte("packfile")))
+		errs <- err
+	}()
+	go func() {
+		_, err := s.List(ctx, storage.StorageResourceState)
+		errs <- err
+	}()
+	go func() {
+		_, err := io.ReadAll(rd)
+		errs <- err
+	}()
+	for range 3 {
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			t.Fatal("requests did not reach the server")
+		}
+	}
+
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Error("a request in flight went through the Close")
+			} else if !errors.Is(err, errStoreClosed) && !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, want the request cancelled", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close left a request running")
+		}
+	}
+}
+
+func TestWriteNoContent(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusOK} {
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			if status == http.StatusOK {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"stored": true}`))
+				return
+			}
+			w.WriteHeader(status)
+		}), map[string]string{"strict_content_type": "true"})
+		ctx := context.Background()
+
+		for _, res := range []storage.StorageResource{storage.StorageResourceState, storage.StorageResourcePackfile, storage.StorageResourceLock} {
+			if n, err := s.Put(ctx, res, objects.MAC{1}, bytes.NewReader([]byte("data"))); err != nil || n != 4 {
+				t.Errorf("%d to a %s upload: %d, %v", status, strres(res), n, err)
+			}
+			if err := s.Delete(ctx, res, objects.MAC{1}); err != nil {
+				t.Errorf("%d to a %s delete: %v", status, strres(res), err)
+			}
+		}
+	}
+}
+
+func TestErrorFields(t *testing.T) {
+	for _, test := range []struct {
+		fields string
+		body   string
+		want   string
+	}{
+		{"", `{"Err": "state is locked"}`, "state is locked"},
+		{"", `{"error": "state is locked"}`, "state is locked"},
+		{"", `{"message": "state is locked", "code": 42}`, "state is locked"},
+		{"", `{"error": {"code": 42, "message": "state is locked"}}`, "state is locked"},
+		{"", `{"Err": "", "error": "state is locked"}`, "state is locked"},
+		{"", `{"detail": "state is locked"}`, `{"detail": "state is locked"}`},
+		{"", `not json`, "not json"},
+		{"detail, reason", `{"error": "generic", "reason": "state is locked"}`, "state is locked"},
+		{"detail", `{"error": "state is locked"}`, `{"error": "state is locked"}`},
+	} {
+		config := map[string]string{"max_retries": "0"}
+		if test.fields != "" {
+			config["error_fields"] = test.fields
+		}
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(test.body))
+		}), config)
+
+		err := s.Delete(context.Background(), storage.StorageResourceState, objects.MAC{1})
+		if err == nil || err.Error() != test.want {
+			t.Errorf("fields %q, body %s: got %v, want %q", test.fields, test.body, err, test.want)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	var mu sync.Mutex
+	repos := map[string]*memServer{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, "/repo/namespaces/")
+		ns, rest, _ := strings.Cut(rest, "/")
+		if !ok || r.Header.Get(namespaceHeader) != ns {
+			t.Errorf("%s %s came with namespace header %q", r.Method, r.URL.Path, r.Header.Get(namespaceHeader))
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		mem := repos[ns]
+		if mem == nil {
+			mem = &memServer{}
+			repos[ns] = mem
+		}
+		mu.Unlock()
+		r.URL.Path = "/" + rest
+		mem.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	stores := map[string]*Store{}
+	for _, ns := range []string{"alpha", "beta"} {
+		s, err := newStore(map[string]string{"location": srv.URL + "/repo", "namespace": ns})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close(context.Background()) })
+		stores[ns] = s
+	}
+	ctx := context.Background()
+
+	if _, err := stores["alpha"].Put(ctx, storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader([]byte("alpha's"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stores["beta"].Put(ctx, storage.StorageResourcePackfile, objects.MAC{2}, bytes.NewReader([]byte("beta's"))); err != nil {
+		t.Fatal(err)
+	}
+	for ns, want := range map[string]objects.MAC{"alpha": {1}, "beta": {2}} {
+		macs, err := stores[ns].List(ctx, storage.StorageResourcePackfile)
+		if err != nil || !slices.Equal(macs, []objects.MAC{want}) {
+			t.Errorf("%s lists %x, %v, want only its own packfile", ns, macs, err)
+		}
+	}
+	if _, err := stores["beta"].Get(ctx, storage.StorageResourcePackfile, objects.MAC{1}, nil); err == nil {
+		t.Error("beta read alpha's packfile")
+	}
+}
+
+func TestNamespaceInvalid(t *testing.T) {
+	for _, ns := range []string{"", ".", "..", "a/b", `a\b`} {
+		if err := ValidateConfig(map[string]string{"location": "http://example.com", "namespace": ns}); err == nil {
+			t.Errorf("namespace %q accepted", ns)
+		}
+	}
+}
+
+func TestUploadContentType(t *testing.T) {
+	for _, test := range []struct {
+		config string
+		want   string
+	}{
+		{"", "application/octet-stream"},
+		{"application/x-plakar-packfile", "application/x-plakar-packfile"},
+	} {
+		var mu sync.Mutex
+		var got []string
+		config := map[string]string{}
+		if test.config != "" {
+			config["upload_content_type"] = test.config
+		}
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			got = append(got, r.Header.Get("Content-Type"))
+			mu.Unlock()
+			io.Copy(io.Discard, r.Body)
+		}), config)
+
+		for _, res := range []storage.StorageResource{storage.StorageResourcePackfile, storage.StorageResourceState, storage.StorageResourceLock} {
+			if _, err := s.Put(context.Background(), res, objects.MAC{1}, bytes.NewReader([]byte{0, 1, 2, 0xff})); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mu.Lock()
+		for _, ct := range got {
+			if ct != test.want {
+				t.Errorf("upload_content_type %q: raw upload sent as %q, want %q", test.config, ct, test.want)
+			}
+		}
+		mu.Unlock()
+	}
+
+	if _, err := newStore(map[string]string{"location": "http://localhost", "upload_content_type": "not a type"}); err == nil {
+		t.Error("an invalid upload_content_type was accepted")
+	}
+}
+
+func TestEagerConnect(t *testing.T) {
+	var hits atomic.Int32
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("repository config"))
+	}))
+	t.Cleanup(auth.Close)
+
+	for _, test := range []struct {
+		location string
+		config   map[string]string
+		ok       bool
+		hits     int32
+	}{
+		{auth.URL, map[string]string{"auth_token": "wrong"}, true, 0},
+		{auth.URL, map[string]string{"auth_token": "wrong", "eager_connect": "true"}, false, 1},
+		{auth.URL, map[string]string{"auth_token": "secret", "eager_connect": "true"}, true, 1},
+		{"http://" + closedPort(t), map[string]string{"eager_connect": "true"}, false, 0},
+		{"http://" + closedPort(t), nil, true, 0},
+	} {
+		hits.Store(0)
+		config := map[string]string{"location": test.location, "max_retries": "0"}
+		for k, v := range test.config {
+			config[k] = v
+		}
+		st, err := NewStore(context.Background(), "http", config)
+		if err == nil {
+			st.Close(context.Background())
+		}
+		if test.ok && err != nil {
+			t.Errorf("%s %v: %v", test.location, test.config, err)
+		} else if !test.ok && (err == nil || !strings.Contains(err.Error(), "connecting to")) {
+			t.Errorf("%s %v: got %v, want the store refused", test.location, test.config, err)
+		}
+		if n := hits.Load(); n != test.hits {
+			t.Errorf("%s %v: %d requests while creating the store, want %d", test.location, test.config, n, test.hits)
+		}
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	var mu sync.Mutex
+	classes := map[string]string{}
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		classes[path.Dir(r.URL.Path)] = r.Header.Get("X-Storage-Class")
+	}), map[string]string{"storage_class": "cold"})
+
+	ctx := context.Background()
+	for _, res := range []storage.StorageResource{storage.StorageResourcePackfile, storage.StorageResourceState} {
+		if _, err := s.Put(ctx, res, objects.MAC{1}, bytes.NewReader([]byte("data"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	if classes["/resources/packfiles"] != "cold" || classes["/resources/states"] != "" {
+		t.Errorf("storage_class cold sent %v, want it on packfiles only", classes)
+	}
+	mu.Unlock()
+
+	if _, err := s.PutWithOptions(ctx, storage.StorageResourcePackfile, objects.MAC{2}, bytes.NewReader([]byte("data")), PutOptions{StorageClass: "hot"}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if classes["/resources/packfiles"] != "hot" {
+		t.Errorf("upload overriding the storage class sent %q, want hot", classes["/resources/packfiles"])
+	}
+	mu.Unlock()
+}
+
+func TestDeleteInPath(t *testing.T) {
+	mac := objects.MAC{0xde, 0xad, 0xbe, 0xef}
+	var mu sync.Mutex
+	var deletes []string
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		deletes = append(deletes, r.Method+" "+r.URL.RequestURI())
+		if len(data) != 0 || r.ContentLength > 0 || len(r.TransferEncoding) != 0 {
+			t.Errorf("%s %s came with %q", r.Method, r.URL.Path, data)
+		}
+	}), nil)
+
+	for _, res := range []storage.StorageResource{storage.StorageResourcePackfile, storage.StorageResourceState, storage.StorageResourceLock} {
+		if err := s.Delete(context.Background(), res, mac); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id := hex.EncodeToString(mac[:])
+	want := []string{
+		"DELETE /resources/packfiles/" + id,
+		"DELETE /resources/states/" + id,
+		"DELETE /resources/locks/" + id,
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(deletes, want) {
+		t.Errorf("got %q, want %q", deletes, want)
+	}
+}
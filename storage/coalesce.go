@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+type flightKey struct {
+	res storage.StorageResource
+	mac objects.MAC
+	rg  storage.Range
+	all bool
+}
+
+type flight struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// flights lets concurrent identical reads share one request: the first
+// caller fetches the object, the others wait for it and each get their
+// own reader over the same bytes.
+type flights struct {
+	mu sync.Mutex
+	m  map[flightKey]*flight
+}
+
+func (f *flights) do(ctx context.Context, key flightKey, fetch func(context.Context) ([]byte, error)) ([]byte, error) {
+	for {
+		f.mu.Lock()
+		fl, ok := f.m[key]
+		if !ok {
+			fl = &flight{done: make(chan struct{})}
+			if f.m == nil {
+				f.m = make(map[flightKey]*flight)
+			}
+			f.m[key] = fl
+			f.mu.Unlock()
+
+			fl.data, fl.err = fetch(ctx)
+			f.mu.Lock()
+			delete(f.m, key)
+			f.mu.Unlock()
+			close(fl.done)
+			return fl.data, fl.err
+		}
+		f.mu.Unlock()
+
+		select {
+		case <-fl.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// the caller that went to fetch gave up, that's no reason
+		// for this one to.
+		if (errors.Is(fl.err, context.Canceled) || errors.Is(fl.err, context.DeadlineExceeded)) && ctx.Err() == nil {
+			continue
+		}
+		return fl.data, fl.err
+	}
+}
+
+// getShared is Get for a store coalescing its reads.
+func (s *Store) getShared(ctx context.Context, res storage.StorageResource, mac objects.MAC, rg *storage.Range) (io.ReadCloser, error) {
+	key := flightKey{res: res, mac: mac, all: rg == nil}
+	if rg != nil {
+		key.rg = *rg
+	}
+	data, err := s.flights.do(ctx, key, func(ctx context.Context) ([]byte, error) {
+		rc, err := s.getOne(ctx, res, mac, rg)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// heldServer serves data once release is closed, counting requests.
+type heldServer struct {
+	data    string
+	release chan struct{}
+	hits    atomic.Int32
+}
+
+func (h *heldServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.hits.Add(1)
+	select {
+	case <-h.release:
+	case <-r.Context().Done():
+		return
+	}
+	w.Write([]byte(h.data))
+}
+
+// getConcurrently issues n identical reads, holds the server until
+// they all had time to get going and returns what each read.
+func getConcurrently(t *testing.T, s *Store, h *heldServer, n int, rg *storage.Range) []string {
+	t.Helper()
+	var wg sync.WaitGroup
+	got := make([]string, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, rg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rd.Close()
+			// each reader is its own, a short read leaves the others whole
+			buf := make([]byte, 4)
+			if i%2 == 0 {
+				k, _ := io.ReadFull(rd, buf)
+				got[i] = string(buf[:k])
+				return
+			}
+			data, _ := io.ReadAll(rd)
+			got[i] = string(data)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(h.release)
+	wg.Wait()
+	return got
+}
+
+func TestCoalesceReads(t *testing.T) {
+	h := &heldServer{data: "shared packfile", release: make(chan struct{})}
+	s, _ := newTestStore(t, h, map[string]string{"coalesce_reads": "true"})
+
+	got := getConcurrently(t, s, h, 10, nil)
+	if n := h.hits.Load(); n != 1 {
+		t.Errorf("10 concurrent identical reads made %d requests, want 1", n)
+	}
+	for i, data := range got {
+		want := "shared packfile"
+		if i%2 == 0 {
+			want = "shar"
+		}
+		if data != want {
+			t.Errorf("read %d got %q, want %q", i, data, want)
+		}
+	}
+
+	// done reads are not kept, the next one goes to the server
+	rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	if n := h.hits.Load(); n != 2 {
+		t.Errorf("read after the shared one: %d requests in all, want 2", n)
+	}
+}
+
+func TestCoalesceReadsOff(t *testing.T) {
+	h := &heldServer{data: "shared packfile", release: make(chan struct{})}
+	s, _ := newTestStore(t, h, nil)
+
+	getConcurrently(t, s, h, 10, nil)
+	if n := h.hits.Load(); n != 10 {
+		t.Errorf("10 concurrent reads without coalesce_reads made %d requests, want 10", n)
+	}
+}
+
+func TestCoalesceReadsKeys(t *testing.T) {
+	var hits atomic.Int32
+	obj := &objectServer{data: []byte("0123456789"), etag: `"v1"`}
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		obj.ServeHTTP(w, r)
+	}), map[string]string{"coalesce_reads": "true"})
+
+	var wg sync.WaitGroup
+	for _, rg := range []*storage.Range{nil, {Offset: 0, Length: 4}, {Offset: 4, Length: 4}} {
+		for _, res := range []storage.StorageResource{storage.StorageResourcePackfile, storage.StorageResourceState} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rd, err := s.Get(context.Background(), res, objects.MAC{1}, rg)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				rd.Close()
+			}()
+		}
+	}
+	wg.Wait()
+	if n := hits.Load(); n != 6 {
+		t.Errorf("6 different reads made %d requests, want 6", n)
+	}
+}
+
+func TestCoalesceReadsLeaderCanceled(t *testing.T) {
+	h := &heldServer{data: "shared packfile", release: make(chan struct{})}
+	s, _ := newTestStore(t, h, map[string]string{"coalesce_reads": "true"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := s.Get(ctx, storage.StorageResourcePackfile, objects.MAC{1}, nil)
+		leader <- err
+	}()
+	for h.hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	follower := make(chan string, 1)
+	go func() {
+		rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, nil)
+		if err != nil {
+			t.Error(err)
+			follower <- ""
+			return
+		}
+		defer rd.Close()
+		data, _ := io.ReadAll(rd)
+		follower <- string(data)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Fatalf("leader got %v, want it canceled", err)
+	}
+	close(h.release)
+	if data := <-follower; data != "shared packfile" {
+		t.Fatalf("follower of a canceled read got %q, want it to fetch on its own", data)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/andybalholm/brotli"
+)
+
+// parseCompression reads which uploads get gzipped.  Packfiles usually
+// are compressed already, states and locks compress well, so it is set
+// per type of object.
+func parseCompression(storeConfig map[string]string) (map[storage.StorageResource]bool, error) {
+	keys := map[string]storage.StorageResource{
+		"compress_packfiles": storage.StorageResourcePackfile,
+		"compress_states":    storage.StorageResourceState,
+		"compress_locks":     storage.StorageResourceLock,
+	}
+
+	ret := make(map[storage.StorageResource]bool)
+	for key, res := range keys {
+		on, err := parseBool(storeConfig, key)
+		if err != nil {
+			return nil, err
+		}
+		if on {
+			ret[res] = true
+		}
+	}
+	return ret, nil
+}
+
+func parseUploadEncoding(storeConfig map[string]string) (string, error) {
+	switch enc := storeConfig["upload_encoding"]; enc {
+	case "", "gzip":
+		return "gzip", nil
+	case "br":
+		return enc, nil
+	default:
+		return "", fmt.Errorf("invalid upload_encoding %q, expected gzip or br", enc)
+	}
+}
+
+// compressing tells whether the body of rq goes out compressed, that
+// stops once the server refused a compressed body.
+func (s *Store) compressing(rq *request) bool {
+	return rq.compress && !s.encodingRejected.Load()
+}
+
+// compressReader compresses rd on the fly with enc.  Closing it stops
+// the compression even if rd was not read to the end.
+func compressReader(rd io.Reader, enc string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var zw io.WriteCloser
+		if enc == "br" {
+			zw = brotli.NewWriter(pw)
+		} else {
+			zw = gzip.NewWriter(pw)
+		}
+		_, err := io.Copy(zw, rd)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/andybalholm/brotli"
+)
+
+// encodingServer decodes uploads, logging the encoding each type of
+// object came in, and refuses encoded ones if plainOnly.
+type encodingServer struct {
+	t         *testing.T
+	plainOnly bool
+
+	mu  sync.Mutex
+	log []string
+}
+
+func (e *encodingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	enc := r.Header.Get("Content-Encoding")
+	if enc != "" && e.plainOnly {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var rd io.Reader = r.Body
+	switch enc {
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			e.t.Error(err)
+			return
+		}
+		rd = zr
+	case "br":
+		rd = brotli.NewReader(r.Body)
+	}
+	data, err := io.ReadAll(rd)
+	if err != nil || string(data) != "some data to store" {
+		e.t.Errorf("%s upload decoded to %q, %v", enc, data, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.log = append(e.log, path.Base(path.Dir(r.URL.Path))+" "+enc)
+}
+
+func (e *encodingServer) uploads() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.log)
+}
+
+func putEach(t *testing.T, s *Store) {
+	t.Helper()
+	for _, res := range []storage.StorageResource{storage.StorageResourcePackfile, storage.StorageResourceState, storage.StorageResourceLock} {
+		if _, err := s.Put(context.Background(), res, objects.MAC{1}, strings.NewReader("some data to store")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompressPerType(t *testing.T) {
+	for _, test := range []struct {
+		config map[string]string
+		want   []string
+	}{
+		{nil, []string{"packfiles ", "states ", "locks "}},
+		{map[string]string{"compress_states": "true", "compress_locks": "true"}, []string{"packfiles ", "states gzip", "locks gzip"}},
+		{map[string]string{"compress_packfiles": "true", "upload_encoding": "br"}, []string{"packfiles br", "states ", "locks "}},
+	} {
+		srv := &encodingServer{t: t}
+		s, _ := newTestStore(t, srv, test.config)
+		putEach(t, s)
+		if got := srv.uploads(); !slices.Equal(got, test.want) {
+			t.Errorf("%v: got uploads %q, want %q", test.config, got, test.want)
+		}
+	}
+}
+
+func TestCompressRejected(t *testing.T) {
+	srv := &encodingServer{t: t, plainOnly: true}
+	s, _ := newTestStore(t, srv, map[string]string{"compress_states": "true"})
+	s.logger = slog.New(&logRecorder{})
+
+	for range 2 {
+		if _, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("some data to store"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := srv.uploads(); !slices.Equal(got, []string{"states ", "states "}) {
+		t.Errorf("got uploads %q, want both states sent as is", got)
+	}
+}
+
+func TestCompressRejectedOnce(t *testing.T) {
+	var mu sync.Mutex
+	encodings := []string{}
+	srv := &encodingServer{t: t, plainOnly: true}
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		mu.Unlock()
+		srv.ServeHTTP(w, r)
+	}), map[string]string{"compress_packfiles": "true", "compress_states": "true"})
+	logs := &logRecorder{}
+	s.logger = slog.New(logs)
+
+	putEach(t, s)
+	putEach(t, s)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"gzip", "", "", "", "", "", ""}; !slices.Equal(encodings, want) {
+		t.Errorf("uploads sent with encodings %q, want %q: one refusal, then plain for good", encodings, want)
+	}
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	if len(logs.records) != 1 {
+		t.Errorf("logged %d records, want the refusal once", len(logs.records))
+	}
+}
+
+func TestCompressRejectedPlainToo(t *testing.T) {
+	var hits int
+	var mu sync.Mutex
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+	}), map[string]string{"compress_states": "true", "max_retries": "0"})
+	s.logger = slog.New(&logRecorder{})
+
+	if _, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, strings.NewReader("some data to store")); err == nil {
+		t.Fatal("a server refusing plain uploads too got no error")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if hits != 2 {
+		t.Errorf("%d requests, want the upload sent plain once", hits)
+	}
+}
+
+func TestCompressRejectedEarly(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusForbidden)
+	}), map[string]string{"compress_packfiles": "true", "max_retries": "0"})
+
+	// random data doesn't compress, the pipe fills up long before the
+	// end of the upload
+	data := make([]byte, 8<<20)
+	rand.Read(data)
+	before := runtime.NumGoroutine()
+	for range 5 {
+		if _, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader(data)); err == nil {
+			t.Fatal("a rejected upload got no error")
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before+1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before+1 {
+		t.Errorf("%d goroutines after 5 rejected uploads, %d before: the compression was left running", n, before)
+	}
+}
+
+func TestCompressRejectedConcurrently(t *testing.T) {
+	srv := &encodingServer{t: t, plainOnly: true}
+	s, _ := newTestStore(t, srv, map[string]string{"compress_states": "true", "max_retries": "0"})
+	logs := &logRecorder{}
+	s.logger = slog.New(logs)
+
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{byte(i)}, strings.NewReader("some data to store")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := len(srv.uploads()); got != 16 {
+		t.Errorf("%d uploads stored, want all 16 sent again as is", got)
+	}
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	if len(logs.records) != 1 {
+		t.Errorf("logged %d records, want the refusal once", len(logs.records))
+	}
+}
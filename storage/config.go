@@ -0,0 +1,265 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseBandwidth reads a bytes per second limit, 0 meaning unlimited.
+func parseBandwidth(storeConfig map[string]string, key string) (int64, error) {
+	value, ok := storeConfig[key]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: expected a number of bytes per second", key, value)
+	}
+	return n, nil
+}
+
+// parseSize reads a number of bytes, 0 when unset.
+func parseSize(storeConfig map[string]string, key string) (int64, error) {
+	value, ok := storeConfig[key]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: expected a number of bytes", key, value)
+	}
+	return n, nil
+}
+
+// parseDuration reads a duration such as "30s", 0 when unset.
+func parseDuration(storeConfig map[string]string, key string) (time.Duration, error) {
+	value, ok := storeConfig[key]
+	if !ok {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q: expected a duration such as 30s", key, value)
+	}
+	return d, nil
+}
+
+// parseCount reads a non-negative integer, 0 when unset.
+func parseCount(storeConfig map[string]string, key string) (int, error) {
+	value, ok := storeConfig[key]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: expected a positive number", key, value)
+	}
+	return n, nil
+}
+
+// parseBool reads a boolean, false when unset.
+func parseBool(storeConfig map[string]string, key string) (bool, error) {
+	value, ok := storeConfig[key]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: expected true or false", key, value)
+	}
+	return b, nil
+}
+
+// loadConfigFile merges the settings of the file named by config_file
+// under those of storeConfig, explicit entries win.  JSON being a
+// subset of YAML, both are accepted.
+func loadConfigFile(storeConfig map[string]string) (map[string]string, error) {
+	filename, ok := storeConfig["config_file"]
+	if !ok {
+		return storeConfig, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("config_file: %w", err)
+	}
+
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("config_file %s: %w", filename, err)
+	}
+
+	merged := make(map[string]string, len(settings)+len(storeConfig))
+	for key, value := range settings {
+		switch value.(type) {
+		case map[string]any, []any:
+			return nil, fmt.Errorf("config_file %s: %s: expected a single value", filename, key)
+		case nil:
+			continue
+		}
+		merged[key] = fmt.Sprint(value)
+	}
+	for key, value := range storeConfig {
+		merged[key] = value
+	}
+	delete(merged, "config_file")
+	return merged, nil
+}
+
+// configKeys are the settings that can also be given in the query of
+// the location, on top of the per-operation <operation>_query and the
+// list_<resource>_min_interval ones.
+var configKeys = []string{
+	"api_versions", "auth_token", "auto_https", "batch_parallelism",
+	"body_capture", "brotli", "cdn_auth_token", "chunked_packfiles",
+	"coalesce_reads", "compress_locks", "compress_packfiles",
+	"compress_states", "conditional_delete", "connection_pool",
+	"content_range", "create_method", "debug_fault_injection_delay",
+	"debug_fault_injection_rate", "diagnose_write", "eager_connect",
+	"error_fields", "expect_continue", "https_port", "idle_conn_timeout",
+	"integrity_algo", "list_page_size", "max_backoff", "max_connections",
+	"max_decompressed_size", "max_download_bandwidth",
+	"max_response_header_bytes", "max_retries", "max_upload_bandwidth",
+	"namespace", "no_retry_on", "nonce_endpoint", "object_ttl",
+	"open_retries", "open_timeout", "password", "protocol", "proxy_auth",
+	"proxy_tunnel", "read_ahead", "read_timeout",
+	"redirect_allowed_hosts", "retrieval_max_wait",
+	"retrieval_poll_interval", "retry_delay", "retry_log_level",
+	"retry_on", "server_version_max", "server_version_min",
+	"short_range", "state_cache", "storage_class",
+	"strict_content_type", "tcp_keepalive", "tls_renegotiation",
+	"tls_server_name", "transactions", "update_method",
+	"upload_chunk_size", "upload_content_type", "upload_encoding",
+	"username", "verify_retried_states", "verify_trailer_digest",
+	"write_timeout",
+}
+
+func isConfigKey(key string) bool {
+	if slices.Contains(configKeys, key) {
+		return true
+	}
+	if op, ok := strings.CutSuffix(key, "_query"); ok && slices.Contains(operations, op) {
+		return true
+	}
+	for _, res := range listedResources {
+		if key == "list_"+strres(res)+"_min_interval" {
+			return true
+		}
+	}
+	return false
+}
+
+// serverParamPrefix marks the query parameters of the location meant
+// for the server rather than the store, any other must be a setting so
+// that a misspelled one doesn't go unnoticed.
+const serverParamPrefix = "param."
+
+// redactURL is value with the password in its user info masked, for
+// error messages.  One that doesn't parse loses its whole user info.
+func redactURL(value string) string {
+	if u, err := url.Parse(value); err == nil {
+		return u.Redacted()
+	}
+	prefix, rest := "", value
+	if scheme, after, ok := strings.Cut(value, "://"); ok {
+		prefix, rest = scheme+"://", after
+	}
+	authority := rest
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		authority = rest[:i]
+	}
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		return prefix + "xxxxx" + rest[i:]
+	}
+	return value
+}
+
+// urlError is what went wrong parsing a URL, without the URL itself
+// that url.Parse quotes in full.
+func urlError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return ue.Err
+	}
+	return err
+}
+
+// loadLocationOptions takes the settings out of the location: the
+// credentials in its user info and the query parameters named after a
+// setting, which are removed from it.  Settings given explicitly win.
+// The parameters prefixed with serverParamPrefix stay in the location,
+// without it, to be sent along with every request.
+func loadLocationOptions(storeConfig map[string]string) (map[string]string, error) {
+	value, ok := storeConfig["location"]
+	if !ok {
+		return storeConfig, nil
+	}
+	location, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q: %w", redactURL(value), urlError(err))
+	}
+
+	// the user info stays in the location, the transport sends it
+	// along up front, and answers the challenges that want more.
+	options := make(map[string]string)
+	if location.User != nil {
+		options["username"] = location.User.Username()
+		if password, ok := location.User.Password(); ok {
+			options["password"] = password
+		}
+	}
+
+	query := location.Query()
+	serverQuery := make(url.Values)
+	for key, values := range query {
+		if param, ok := strings.CutPrefix(key, serverParamPrefix); ok {
+			serverQuery[param] = values
+			continue
+		}
+		if !isConfigKey(key) {
+			return nil, fmt.Errorf("invalid URL %q: unknown setting %q, parameters for the server go as %s%s", redactURL(value), key, serverParamPrefix, key)
+		}
+		if len(values) != 1 {
+			return nil, fmt.Errorf("invalid URL %q: %s given %d times", redactURL(value), key, len(values))
+		}
+		options[key] = values[0]
+	}
+	if len(query) == 0 && len(options) == 0 {
+		return storeConfig, nil
+	}
+	location.RawQuery = serverQuery.Encode()
+
+	merged := make(map[string]string, len(storeConfig)+len(options))
+	for key, value := range options {
+		merged[key] = value
+	}
+	for key, value := range storeConfig {
+		merged[key] = value
+	}
+	merged["location"] = location.String()
+	return merged, nil
+}
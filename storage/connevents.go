@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"net/http/httptrace"
+	"time"
+)
+
+type ConnEventKind string
+
+const (
+	// a connection was dialed for a request
+	ConnNew ConnEventKind = "new"
+	// a pooled connection was picked up for a request
+	ConnReused ConnEventKind = "reused"
+	// every following request goes to another endpoint, as when
+	// auto_https upgrades the location
+	ConnEndpointSwitched ConnEventKind = "endpoint_switched"
+)
+
+type ConnEvent struct {
+	Time time.Time
+	Kind ConnEventKind
+	Addr string // remote address, or the endpoint switched to
+}
+
+// SetConnEventHook installs fn to be told about connections being made
+// and reused and about endpoint switches.  Requests are only traced
+// while a hook is installed, and fn is called synchronously so it
+// should not block.
+func (s *Store) SetConnEventHook(fn func(ConnEvent)) {
+	if fn == nil {
+		s.connHook.Store(nil)
+		return
+	}
+	s.connHook.Store(&fn)
+}
+
+func (s *Store) connEvent(kind ConnEventKind, addr string) {
+	if fn := s.connHook.Load(); fn != nil {
+		(*fn)(ConnEvent{Time: s.clock.Now(), Kind: kind, Addr: addr})
+	}
+}
+
+// traceConns has the connection a request gets reported, when a hook
+// wants to know.
+func (s *Store) traceConns(ctx context.Context) context.Context {
+	if s.connHook.Load() == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			kind := ConnNew
+			if info.Reused {
+				kind = ConnReused
+			}
+			s.connEvent(kind, info.Conn.RemoteAddr().String())
+		},
+	})
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// connEvents collects the events a hook is told about.
+type connEvents struct {
+	mu     sync.Mutex
+	events []ConnEvent
+}
+
+func (c *connEvents) hook(ev ConnEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, ev)
+}
+
+func (c *connEvents) kinds() []ConnEventKind {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ret []ConnEventKind
+	for _, ev := range c.events {
+		ret = append(ret, ev.Kind)
+	}
+	return ret
+}
+
+func TestConnEvents(t *testing.T) {
+	var hits atomic.Int32
+	s, srv := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch hits.Add(1) {
+		case 2:
+			// the connection fails, the next request needs another
+			w.Header().Set("Connection", "close")
+		case 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}), nil)
+	events := &connEvents{}
+	s.SetConnEventHook(events.hook)
+
+	for range 3 {
+		if err := getState(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []ConnEventKind{ConnNew, ConnReused, ConnNew, ConnReused}
+	if got := events.kinds(); !slices.Equal(got, want) {
+		t.Fatalf("got events %v, want %v", got, want)
+	}
+	addr := srv.Listener.Addr().String()
+	for _, ev := range events.events {
+		if ev.Addr != addr || ev.Time.IsZero() {
+			t.Errorf("event %v, want it timed and for %s", ev, addr)
+		}
+	}
+
+	s.SetConnEventHook(nil)
+	getState(s)
+	if got := events.kinds(); len(got) != len(want) {
+		t.Errorf("events %v reported after the hook was removed", got[len(want):])
+	}
+}
+
+func TestConnEventsEndpointSwitched(t *testing.T) {
+	tlsSrv := httptest.NewTLSServer(&httpsServer{})
+	t.Cleanup(tlsSrv.Close)
+	tlsURL, _ := url.Parse(tlsSrv.URL)
+
+	s := newUpgradingStore(t, "http://"+closedPort(t), tlsSrv, map[string]string{"auto_https": "true", "https_port": tlsURL.Port()})
+	events := &connEvents{}
+	s.SetConnEventHook(events.hook)
+	if err := getState(s); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ConnEventKind{ConnEndpointSwitched, ConnNew}
+	if got := events.kinds(); !slices.Equal(got, want) {
+		t.Fatalf("got events %v, want %v", got, want)
+	}
+	if ev := events.events[0]; ev.Addr != tlsURL.Host {
+		t.Errorf("switched to %s, want %s", ev.Addr, tlsURL.Host)
+	}
+}
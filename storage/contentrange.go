@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+)
+
+type contentRangeMode int
+
+const (
+	contentRangeOff contentRangeMode = iota
+	contentRangeLenient
+	contentRangeStrict
+)
+
+func parseContentRangeMode(storeConfig map[string]string) (contentRangeMode, error) {
+	switch value := storeConfig["content_range"]; value {
+	case "", "off":
+		return contentRangeOff, nil
+	case "lenient":
+		return contentRangeLenient, nil
+	case "strict":
+		return contentRangeStrict, nil
+	default:
+		return 0, fmt.Errorf("invalid content_range %q: expected off, lenient or strict", value)
+	}
+}
+
+// parseContentRange reads "bytes first-last/total", total is -1 when
+// the server sent "*".
+func parseContentRange(value string) (first, last, total int64, err error) {
+	spec, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	span, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	a, b, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	if first, err = strconv.ParseInt(a, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	if last, err = strconv.ParseInt(b, 10, 64); err != nil || last < first {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total <= last {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+		}
+	}
+	return first, last, total, nil
+}
+
+// rangeHeader asks for the Length bytes at Offset, the end of a Range
+// is inclusive.
+func rangeHeader(rg *storage.Range) string {
+	return fmt.Sprintf("bytes=%d-%d", rg.Offset, rg.Offset+uint64(rg.Length)-1)
+}
+
+// checkContentRange holds the range a 206 says it carries against the
+// one asked for.  Strict wants exactly that, lenient also takes a range
+// cut short at the last byte of the object, but not one starting
+// elsewhere.  The length of such a clamped range is returned, -1 when
+// the range is the one asked for.
+func (s *Store) checkContentRange(r *http.Response, rg *storage.Range) (int64, error) {
+	if s.contentRange == contentRangeOff || r.StatusCode != http.StatusPartialContent {
+		return -1, nil
+	}
+
+	value := r.Header.Get("Content-Range")
+	if value == "" {
+		return -1, fmt.Errorf("partial response without a Content-Range")
+	}
+	first, last, total, err := parseContentRange(value)
+	if err != nil {
+		return -1, err
+	}
+
+	start := int64(rg.Offset)
+	end := start + int64(rg.Length) - 1
+	if first == start && last == end {
+		return -1, nil
+	}
+	if s.contentRange == contentRangeLenient && first == start &&
+		total >= 0 && last == total-1 && last < end {
+		return last - first + 1, nil
+	}
+	return -1, fmt.Errorf("server sent range %q for %s", value, rangeHeader(rg))
+}
+
+// clampedBody is a range cut short at the end of the object, the read
+// is complete once its length is in.
+type clampedBody struct {
+	io.ReadCloser
+	length int64
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestRangeHeader(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Range"); got != "bytes=2-5" {
+			t.Errorf("Range %q, want bytes=2-5", got)
+		}
+		w.Header().Set("Content-Range", "bytes 2-5/16")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("2345"))
+	}), map[string]string{"content_range": "strict"})
+
+	if got := readRange(t, s, 2, 4); got != "2345" {
+		t.Errorf("got %q, want 2345", got)
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	// 4 bytes asked for at offset 10, the clamped range is what's left
+	// of a 12 bytes object
+	const (
+		exact   = "bytes 10-13/20"
+		clamped = "bytes 10-11/12"
+		wrong   = "bytes 8-11/20"
+	)
+	bodies := map[string]string{exact: "abcd", clamped: "ab", wrong: "abcd"}
+	tests := []struct {
+		mode         string
+		contentRange string
+		ok           bool
+	}{
+		{"off", exact, true},
+		// the header goes unread, 2 bytes of 4 is a short read
+		{"off", clamped, false},
+		{"off", wrong, true},
+		{"lenient", exact, true},
+		{"lenient", clamped, true},
+		{"lenient", wrong, false},
+		{"strict", exact, true},
+		{"strict", clamped, false},
+		{"strict", wrong, false},
+	}
+	for _, test := range tests {
+		t.Run(test.mode+" "+test.contentRange, func(t *testing.T) {
+			s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", test.contentRange)
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte(bodies[test.contentRange]))
+			}), map[string]string{"content_range": test.mode})
+
+			var data []byte
+			rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, &storage.Range{Offset: 10, Length: 4})
+			if err == nil {
+				data, err = io.ReadAll(rd)
+				rd.Close()
+			}
+			if (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+			if err == nil && string(data) != bodies[test.contentRange] {
+				t.Errorf("read %q, want %q", data, bodies[test.contentRange])
+			}
+		})
+	}
+}
+
+func TestContentRangeMode(t *testing.T) {
+	if _, err := parseContentRangeMode(map[string]string{"content_range": "loose"}); err == nil {
+		t.Error("content_range=loose accepted")
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// SetContextHeaders makes every request carry, for each context key in
+// m, the value found under that key in the request's context as the
+// header m[key].  This is how application identifiers such as a tenant
+// or a job ID reach the server.  Keys without a value in the context
+// are skipped.
+func (s *Store) SetContextHeaders(m map[any]string) {
+	headers := make(map[any]string, len(m))
+	for k, v := range m {
+		headers[k] = http.CanonicalHeaderKey(v)
+	}
+
+	s.ctxHeadersMu.Lock()
+	defer s.ctxHeadersMu.Unlock()
+	s.ctxHeaders = headers
+}
+
+func (s *Store) applyContextHeaders(ctx context.Context, h http.Header) {
+	s.ctxHeadersMu.Lock()
+	headers := s.ctxHeaders
+	s.ctxHeadersMu.Unlock()
+
+	for key, name := range headers {
+		v := ctx.Value(key)
+		if v == nil {
+			continue
+		}
+		h.Set(name, fmt.Sprint(v))
+	}
+}
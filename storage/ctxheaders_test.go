@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+type tenantKey struct{}
+type jobKey struct{}
+
+func TestContextHeaders(t *testing.T) {
+	var mu sync.Mutex
+	var got []http.Header
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.Header.Clone())
+		mu.Unlock()
+	}), nil)
+	s.SetContextHeaders(map[any]string{
+		tenantKey{}: "x-tenant",
+		jobKey{}:    "X-Job-Id",
+		"unset":     "X-Unset",
+	})
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	ctx = context.WithValue(ctx, jobKey{}, 42)
+	if _, err := s.Put(ctx, storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("state"))); err != nil {
+		t.Fatal(err)
+	}
+	// without a job this time
+	ctx = context.WithValue(context.Background(), tenantKey{}, "acme")
+	if err := s.Delete(ctx, storage.StorageResourceState, objects.MAC{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("server got %d requests, want 2", len(got))
+	}
+	for i, want := range []map[string]string{
+		{"X-Tenant": "acme", "X-Job-Id": "42"},
+		{"X-Tenant": "acme"},
+	} {
+		for _, name := range []string{"X-Tenant", "X-Job-Id", "X-Unset"} {
+			v, ok := got[i].Get(name), len(got[i].Values(name)) != 0
+			if v != want[name] || ok != (want[name] != "") {
+				t.Errorf("request %d: %s is %q, want %q", i+1, name, v, want[name])
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// listedResources are the resources whose listing can be debounced,
+// with list_<resource>_min_interval.
+var listedResources = []storage.StorageResource{
+	storage.StorageResourcePackfile,
+	storage.StorageResourceState,
+	storage.StorageResourceLock,
+	storage.StorageResourceECCPackfile,
+	storage.StorageResourceECCState,
+}
+
+// debouncedList hands out the previous listing of a resource when asked
+// again within interval, so that a caller polling the locks in a tight
+// loop doesn't hammer the server.
+type debouncedList struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	valid bool
+	at    time.Time
+	macs  []objects.MAC
+
+	// the listing in flight, if any, and the count of invalidations
+	// that tells whether it is still good to keep once done
+	pending *listFetch
+	gen     uint64
+}
+
+// listFetch is a listing the callers arriving while it runs wait for.
+type listFetch struct {
+	done chan struct{}
+	macs []objects.MAC
+	err  error
+}
+
+func parseListIntervals(storeConfig map[string]string) (map[storage.StorageResource]*debouncedList, error) {
+	var ret map[storage.StorageResource]*debouncedList
+	for _, res := range listedResources {
+		interval, err := parseDuration(storeConfig, "list_"+strres(res)+"_min_interval")
+		if err != nil {
+			return nil, err
+		}
+		if interval == 0 {
+			continue
+		}
+		if ret == nil {
+			ret = make(map[storage.StorageResource]*debouncedList)
+		}
+		ret[res] = &debouncedList{interval: interval}
+	}
+	return ret, nil
+}
+
+// get returns the listing made less than interval ago or, failing that,
+// makes a new one with fetch.  Concurrent callers wait for the same
+// listing rather than each making one, each for as long as its own ctx
+// allows.
+func (d *debouncedList) get(ctx context.Context, c clock, fetch func(context.Context) ([]objects.MAC, error)) ([]objects.MAC, error) {
+	for {
+		d.mu.Lock()
+		if d.valid && c.Now().Sub(d.at) < d.interval {
+			macs := slices.Clone(d.macs)
+			d.mu.Unlock()
+			return macs, nil
+		}
+		f := d.pending
+		if f == nil {
+			f = &listFetch{done: make(chan struct{})}
+			d.pending = f
+			gen := d.gen
+			d.mu.Unlock()
+
+			f.macs, f.err = fetch(ctx)
+			d.mu.Lock()
+			if d.pending == f {
+				d.pending = nil
+			}
+			// a write that came along meanwhile may be missing
+			if f.err == nil && d.gen == gen {
+				d.valid = true
+				d.at = c.Now()
+				d.macs = f.macs
+			}
+			d.mu.Unlock()
+			close(f.done)
+		} else {
+			d.mu.Unlock()
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			// the caller making the listing gave up, not this one
+			if ctx.Err() == nil && (errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded)) {
+				continue
+			}
+		}
+
+		if f.err != nil {
+			return nil, f.err
+		}
+		return slices.Clone(f.macs), nil
+	}
+}
+
+// invalidate makes the next listing hit the server, the store's own
+// writes must show up right away.
+func (d *debouncedList) invalidate() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.valid = false
+	d.macs = nil
+	// callers coming after don't wait for a listing started before
+	d.pending = nil
+	d.gen++
+}
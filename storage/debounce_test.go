@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestListMinInterval(t *testing.T) {
+	ctx := context.Background()
+	var lists atomic.Int32
+	mem := &memServer{}
+	clock := newFakeClock()
+	s, _ := newTestStoreClock(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Count(r.URL.Path, "/") == 2 {
+			lists.Add(1)
+		}
+		mem.ServeHTTP(w, r)
+	}), map[string]string{"list_locks_min_interval": "10s"}, clock)
+
+	for range 10 {
+		if _, err := s.List(ctx, storage.StorageResourceLock); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := lists.Load(); n != 1 {
+		t.Fatalf("10 listings within the interval hit the server %d times, want 1", n)
+	}
+
+	clock.Advance(10 * time.Second)
+	s.List(ctx, storage.StorageResourceLock)
+	if n := lists.Load(); n != 2 {
+		t.Fatalf("a listing after the interval hit the server %d times in all, want 2", n)
+	}
+
+	// the store's own writes show up right away
+	if _, err := s.Put(ctx, storage.StorageResourceLock, objects.MAC{1}, bytes.NewReader([]byte("lock"))); err != nil {
+		t.Fatal(err)
+	}
+	macs, err := s.List(ctx, storage.StorageResourceLock)
+	if err != nil || len(macs) != 1 || macs[0] != (objects.MAC{1}) {
+		t.Fatalf("listing after Put: %v, %v", macs, err)
+	}
+	if err := s.Delete(ctx, storage.StorageResourceLock, objects.MAC{1}); err != nil {
+		t.Fatal(err)
+	}
+	if macs, err := s.List(ctx, storage.StorageResourceLock); err != nil || len(macs) != 0 {
+		t.Fatalf("listing after Delete: %v, %v", macs, err)
+	}
+
+	// other resources are not debounced
+	before := lists.Load()
+	s.List(ctx, storage.StorageResourceState)
+	s.List(ctx, storage.StorageResourceState)
+	if n := lists.Load() - before; n != 2 {
+		t.Fatalf("2 state listings hit the server %d times, want 2", n)
+	}
+}
+
+func TestListMinIntervalConcurrent(t *testing.T) {
+	var lists atomic.Int32
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lists.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("[]"))
+	}), map[string]string{"list_locks_min_interval": "1h"})
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.List(context.Background(), storage.StorageResourceLock); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := lists.Load(); n != 1 {
+		t.Fatalf("20 concurrent listings hit the server %d times, want 1", n)
+	}
+}
+
+func TestListMinIntervalSlowListing(t *testing.T) {
+	listing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			listing <- struct{}{}
+			<-release
+			w.Write([]byte("[]"))
+			return
+		}
+		io.Copy(io.Discard, r.Body)
+	}), map[string]string{"list_locks_min_interval": "1h"})
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	t.Cleanup(unblock)
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := s.List(context.Background(), storage.StorageResourceLock)
+		first <- err
+	}()
+	<-listing
+
+	// a second caller gives up on its own deadline, and a write goes
+	// through, while the listing hangs
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.List(ctx, storage.StorageResourceLock)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("got %v, want the caller's deadline", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a caller waited for a listing past its deadline")
+	}
+	go func() {
+		_, err := s.Put(context.Background(), storage.StorageResourceLock, objects.MAC{1}, bytes.NewReader([]byte("lock")))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a write waited for a listing in flight")
+	}
+
+	unblock()
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListMinIntervalConfig(t *testing.T) {
+	if _, err := newStore(map[string]string{"location": "http://localhost", "list_locks_min_interval": "often"}); err == nil {
+		t.Fatal("an unparsable list_locks_min_interval was accepted")
+	}
+}
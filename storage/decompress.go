@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+const defaultMaxDecompressedSize = 1 << 30
+
+// limitedBody stops a compressed response from blowing up past limit
+// once decompressed.
+type limitedBody struct {
+	rc    io.ReadCloser
+	limit int64
+	n     int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.n >= l.limit {
+		// anything past the limit is an error, not just a truncation
+		var probe [1]byte
+		k, err := l.rc.Read(probe[:])
+		if k > 0 {
+			return 0, fmt.Errorf("decompressed response exceeds %d bytes", l.limit)
+		}
+		return 0, err
+	}
+	if rest := l.limit - l.n; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	k, err := l.rc.Read(p)
+	l.n += int64(k)
+	return k, err
+}
+
+func (l *limitedBody) Close() error {
+	return l.rc.Close()
+}
+
+// acceptEncoding is what the store offers when it decodes responses
+// itself rather than leaving it to the transport, which only knows gzip.
+func acceptEncoding(brotli bool) string {
+	if brotli {
+		return "br, gzip"
+	}
+	return "gzip"
+}
+
+// decodeResponse replaces an encoded body with the decoded one, the way
+// the transport does on its own for gzip.
+func decodeResponse(r *http.Response) {
+	enc := r.Header.Get("Content-Encoding")
+	if enc != "br" && enc != "gzip" {
+		return
+	}
+	r.Body = &decodingBody{rc: r.Body, enc: enc}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	r.Uncompressed = true
+}
+
+// gzipReaders are reused across responses, a gzip.Reader carries a
+// sizeable decompression window.
+var gzipReaders sync.Pool
+
+// decodingBody sets its decoder up on the first read, an empty body as
+// sent with a 204 has no gzip header to read.  It may be closed while a
+// read is blocked in another goroutine, the gzip reader then goes back
+// to the pool once that read returns.
+type decodingBody struct {
+	rc  io.ReadCloser
+	enc string
+
+	mu      sync.Mutex
+	rd      io.Reader
+	zr      *gzip.Reader
+	reading bool
+	closed  bool
+}
+
+func (d *decodingBody) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	if d.rd == nil {
+		if err := d.setup(); err != nil {
+			d.mu.Unlock()
+			return 0, err
+		}
+	}
+	rd := d.rd
+	d.reading = true
+	d.mu.Unlock()
+
+	n, err := rd.Read(p)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reading = false
+	if d.closed {
+		d.release()
+	}
+	return n, err
+}
+
+func (d *decodingBody) setup() error {
+	if d.enc == "br" {
+		d.rd = brotli.NewReader(d.rc)
+		return nil
+	}
+	zr, _ := gzipReaders.Get().(*gzip.Reader)
+	var err error
+	if zr == nil {
+		zr, err = gzip.NewReader(d.rc)
+	} else {
+		err = zr.Reset(d.rc)
+	}
+	if err != nil {
+		// a reader that failed to reset is fine to reuse
+		if zr != nil {
+			gzipReaders.Put(zr)
+		}
+		return err
+	}
+	d.zr = zr
+	d.rd = zr
+	return nil
+}
+
+// release hands the gzip reader back whether or not the body was read
+// to the end, Reset discards whatever state it was left in.
+func (d *decodingBody) release() {
+	if d.zr != nil {
+		gzipReaders.Put(d.zr)
+		d.zr = nil
+	}
+}
+
+func (d *decodingBody) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	if !d.reading {
+		d.release()
+	}
+	d.mu.Unlock()
+	return d.rc.Close()
+}
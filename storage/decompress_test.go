@@ -0,0 +1,263 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+	"github.com/andybalholm/brotli"
+)
+
+func TestBrotliResponse(t *testing.T) {
+	want := strings.Repeat("brotli encoded state ", 100)
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "br") {
+			t.Errorf("Accept-Encoding %q doesn't offer br", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "br")
+		bw := brotli.NewWriter(w)
+		io.WriteString(bw, want)
+		bw.Close()
+	}), nil)
+
+	rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	got, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestBrotliDisabled(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "br") {
+			t.Errorf("Accept-Encoding %q offers br", r.Header.Get("Accept-Encoding"))
+		}
+	}), map[string]string{"brotli": "false"})
+
+	rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+}
+
+func TestEncodedRangeRefused(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(bytes.Repeat([]byte("0123456789abcdef"), 64))
+	zw.Close()
+
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(buf.Bytes()[2:6])
+	}), nil)
+
+	_, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, &storage.Range{Offset: 2, Length: 4})
+	if err == nil || !strings.Contains(err.Error(), "gzip encoded range") {
+		t.Fatalf("got error %v, want the encoded range refused", err)
+	}
+}
+
+func gzipped(t testing.TB, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestDecodingBodyCloseDuringRead(t *testing.T) {
+	// random enough to span several deflate blocks
+	data := make([]byte, 1<<18)
+	rand.NewChaCha8([32]byte{}).Read(data)
+	compressed := gzipped(t, data)
+	pr, pw := io.Pipe()
+	d := &decodingBody{rc: pr, enc: "gzip"}
+
+	// the header and a first block go through, then the body stalls
+	go pw.Write(compressed[:len(compressed)/2])
+	if _, err := io.ReadFull(d, make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, d)
+		done <- err
+	}()
+	// wait for the read to be blocked on the pipe
+	for {
+		d.mu.Lock()
+		reading := d.reading
+		d.mu.Unlock()
+		if reading {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	d.Close()
+	d.mu.Lock()
+	released := d.zr == nil
+	d.mu.Unlock()
+	if released {
+		t.Fatal("gzip reader pooled while a read is in flight")
+	}
+
+	if err := <-done; err == nil {
+		t.Error("read of a closed body succeeded")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.zr != nil {
+		t.Error("gzip reader not pooled once the read returned")
+	}
+}
+
+func TestDecodingBodyConcurrent(t *testing.T) {
+	want := bytes.Repeat([]byte("payload "), 1<<10)
+	compressed := gzipped(t, want)
+
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				d := &decodingBody{rc: io.NopCloser(bytes.NewReader(compressed)), enc: "gzip"}
+				got, err := io.ReadAll(d)
+				d.Close()
+				if err != nil || !bytes.Equal(got, want) {
+					t.Errorf("got %d bytes, %v", len(got), err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkDecodeGzip(b *testing.B) {
+	compressed := gzipped(b, bytes.Repeat([]byte("payload "), 1<<12))
+	buf := make([]byte, 32<<10)
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			d := &decodingBody{rc: io.NopCloser(bytes.NewReader(compressed)), enc: "gzip"}
+			io.CopyBuffer(io.Discard, d, buf)
+			d.Close()
+		}
+	})
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			zr, err := gzip.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				b.Fatal(err)
+			}
+			io.CopyBuffer(io.Discard, zr, buf)
+			zr.Close()
+		}
+	})
+}
+
+func TestDecompressedSizeLimit(t *testing.T) {
+	const size = 4 << 20
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(make([]byte, size))
+	zw.Close()
+
+	for _, test := range []struct {
+		limit string
+		ok    bool
+	}{
+		{"65536", false},
+		{"4194303", false},
+		{"4194304", true},
+		{"0", true},
+	} {
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(bomb.Bytes())
+		}), map[string]string{"max_decompressed_size": test.limit})
+
+		rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, rd)
+		rd.Close()
+		if test.ok && (err != nil || n != size) {
+			t.Errorf("limit %s: read %d bytes, %v, want all %d", test.limit, n, err, size)
+		} else if !test.ok && (err == nil || !strings.Contains(err.Error(), "exceeds "+test.limit)) {
+			t.Errorf("limit %s: read %d bytes, %v, want the limit enforced", test.limit, n, err)
+		}
+	}
+}
+
+func TestRangeNotCompressed(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// compresses whenever allowed, Range or not
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped(t, data))
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}), nil)
+
+	for _, rg := range []*storage.Range{{Offset: 18, Length: 5}, nil} {
+		want := data
+		if rg != nil {
+			want = data[rg.Offset : rg.Offset+uint64(rg.Length)]
+		}
+		rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, rg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rd)
+		rd.Close()
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("range %v: got %q, %v, want %q", rg, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// certExpiryWarning is how close to expiring a certificate gets flagged
+// in the report, while still passing.
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// DiagnosticReport is the outcome of Diagnose, one step per check in
+// the order they ran.
+type DiagnosticReport struct {
+	Steps []DiagnosticStep
+
+	// Certificates is the chain the server presented, leaf first,
+	// empty for a plain http location.
+	Certificates []DiagnosticCert
+}
+
+// Failed returns the first step that failed, nil if none did.
+func (r *DiagnosticReport) Failed() *DiagnosticStep {
+	for i := range r.Steps {
+		if r.Steps[i].Err != nil {
+			return &r.Steps[i]
+		}
+	}
+	return nil
+}
+
+// DiagnosticStep is a single check.  A skipped one didn't run, Detail
+// says why.
+type DiagnosticStep struct {
+	Name     string
+	Duration time.Duration
+	Skipped  bool
+	Detail   string
+	Err      error
+}
+
+type DiagnosticCert struct {
+	Subject  string
+	Issuer   string
+	NotAfter time.Time
+}
+
+// diagnosis runs the steps of a Diagnose, each one skipped once one
+// has failed unless it cleans up after an earlier one.
+type diagnosis struct {
+	s      *Store
+	report DiagnosticReport
+	failed bool
+}
+
+func (d *diagnosis) run(ctx context.Context, name string, fn func(ctx context.Context) (string, error)) bool {
+	if d.failed {
+		d.skip(name, "an earlier step failed")
+		return false
+	}
+	return d.always(ctx, name, fn)
+}
+
+func (d *diagnosis) always(ctx context.Context, name string, fn func(ctx context.Context) (string, error)) bool {
+	start := d.s.clock.Now()
+	detail, err := fn(ctx)
+	d.report.Steps = append(d.report.Steps, DiagnosticStep{
+		Name:     name,
+		Duration: d.s.clock.Now().Sub(start),
+		Detail:   detail,
+		Err:      err,
+	})
+	if err != nil {
+		d.failed = true
+	}
+	return err == nil
+}
+
+func (d *diagnosis) skip(name, why string) {
+	d.report.Steps = append(d.report.Steps, DiagnosticStep{Name: name, Skipped: true, Detail: why})
+}
+
+// Diagnose checks the way to the server one step at a time: resolving
+// its name, connecting, the TLS handshake, reading the repository
+// config and, with diagnose_write, writing, reading back and deleting a
+// lock.  A step that fails skips the ones depending on it.  The error is
+// that of the first failed step, the report is complete either way.
+func (s *Store) Diagnose(ctx context.Context) (DiagnosticReport, error) {
+	d := &diagnosis{s: s}
+
+	base := s.baseURL()
+	host := base.Hostname()
+	port := base.Port()
+	if port == "" {
+		port = "80"
+		if base.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+
+	if net.ParseIP(host) != nil {
+		d.skip("dns", "the location is an address")
+	} else {
+		d.run(ctx, "dns", func(ctx context.Context) (string, error) {
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				return "", err
+			}
+			return strings.Join(addrs, ", "), nil
+		})
+	}
+
+	d.run(ctx, "tcp", func(ctx context.Context) (string, error) {
+		conn, err := s.transport.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return conn.RemoteAddr().String(), nil
+	})
+
+	if base.Scheme != "https" {
+		d.skip("tls", "plain http location")
+	} else {
+		d.run(ctx, "tls", func(ctx context.Context) (string, error) {
+			state, err := s.diagnoseTLS(ctx, host, addr)
+			if err != nil {
+				return "", err
+			}
+			now := s.clock.Now()
+			detail := tls.VersionName(state.Version) + ", " + tls.CipherSuiteName(state.CipherSuite)
+			for _, cert := range state.PeerCertificates {
+				d.report.Certificates = append(d.report.Certificates, DiagnosticCert{
+					Subject:  cert.Subject.String(),
+					Issuer:   cert.Issuer.String(),
+					NotAfter: cert.NotAfter,
+				})
+				if left := cert.NotAfter.Sub(now); left < certExpiryWarning {
+					detail += fmt.Sprintf(", %q expires in %s", cert.Subject.CommonName, left.Round(time.Hour))
+				}
+			}
+			return detail, nil
+		})
+	}
+
+	// no retries, a server that needs them is worth reporting
+	d.run(ctx, "open", func(ctx context.Context) (string, error) {
+		config, err := doRequest[[]byte](ctx, s, &request{op: opOpen, method: "GET", path: "/", retry: &retryPolicy{}})
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d bytes of config", len(config)), nil
+	})
+
+	if s.diagnoseWrite {
+		s.diagnoseWrites(ctx, d)
+	} else {
+		for _, name := range []string{"write", "read", "delete"} {
+			d.skip(name, "diagnose_write is not set")
+		}
+	}
+
+	if step := d.report.Failed(); step != nil {
+		return d.report, fmt.Errorf("%s: %w", step.Name, step.Err)
+	}
+	return d.report, nil
+}
+
+// diagnoseTLS shakes hands with the server the way requests do, over a
+// connection of its own.
+func (s *Store) diagnoseTLS(ctx context.Context, host, addr string) (tls.ConnectionState, error) {
+	if s.transport.DialTLSContext != nil {
+		conn, err := s.transport.DialTLSContext(ctx, "tcp", addr)
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.Close()
+		return conn.(*tls.Conn).ConnectionState(), nil
+	}
+
+	conn, err := s.transport.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+
+	cfg := &tls.Config{}
+	if s.transport.TLSClientConfig != nil {
+		cfg = s.transport.TLSClientConfig.Clone()
+	}
+	cfg.ServerName = host
+	tconn := tls.Client(conn, cfg)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		return tls.ConnectionState{}, err
+	}
+	return tconn.ConnectionState(), nil
+}
+
+// diagnoseWrites round-trips a lock under a random MAC, and deletes it
+// whenever it was written.
+func (s *Store) diagnoseWrites(ctx context.Context, d *diagnosis) {
+	var mac objects.MAC
+	rand.Read(mac[:])
+	data := []byte("plakar diagnose " + s.clock.Now().UTC().Format(time.RFC3339))
+
+	written := d.run(ctx, "write", func(ctx context.Context) (string, error) {
+		n, err := s.Put(ctx, storage.StorageResourceLock, mac, bytes.NewReader(data))
+		return fmt.Sprintf("%d bytes to lock %x", n, mac), err
+	})
+	d.run(ctx, "read", func(ctx context.Context) (string, error) {
+		rd, err := s.Get(ctx, storage.StorageResourceLock, mac, nil)
+		if err != nil {
+			return "", err
+		}
+		defer rd.Close()
+		got, err := io.ReadAll(rd)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(got, data) {
+			return "", fmt.Errorf("read back %d bytes differing from the %d written", len(got), len(data))
+		}
+		return fmt.Sprintf("%d bytes", len(got)), nil
+	})
+	if !written {
+		d.skip("delete", "nothing was written")
+		return
+	}
+	d.always(ctx, "delete", func(ctx context.Context) (string, error) {
+		return "", s.Delete(ctx, storage.StorageResourceLock, mac)
+	})
+}
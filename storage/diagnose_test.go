@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stepStates sums a report up as name=ok, name=skipped or name=failed.
+func stepStates(report DiagnosticReport) []string {
+	var ret []string
+	for _, step := range report.Steps {
+		state := "ok"
+		if step.Skipped {
+			state = "skipped"
+		} else if step.Err != nil {
+			state = "failed"
+		}
+		ret = append(ret, step.Name+"="+state)
+	}
+	return ret
+}
+
+func TestDiagnose(t *testing.T) {
+	mem := &memServer{config: []byte("repository config")}
+	s, _ := newTestStore(t, mem, map[string]string{"diagnose_write": "true"})
+
+	report, err := s.Diagnose(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"dns=skipped", "tcp=ok", "tls=skipped", "open=ok", "write=ok", "read=ok", "delete=ok"}
+	if got := stepStates(report); !slices.Equal(got, want) {
+		t.Fatalf("steps %v, want %v", got, want)
+	}
+	if report.Failed() != nil || len(report.Certificates) != 0 {
+		t.Errorf("report %+v of a healthy plain http server", report)
+	}
+	if detail := report.Steps[3].Detail; detail != "17 bytes of config" {
+		t.Errorf("open step detail %q", detail)
+	}
+	// the lock written is gone
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if len(mem.objects) != 0 {
+		t.Errorf("diagnose left %d objects behind", len(mem.objects))
+	}
+}
+
+func TestDiagnoseNoWrite(t *testing.T) {
+	srv := httptest.NewServer(&memServer{})
+	t.Cleanup(srv.Close)
+	s, err := newStore(map[string]string{"location": strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(context.Background())
+
+	report, err := s.Diagnose(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"dns=ok", "tcp=ok", "tls=skipped", "open=ok", "write=skipped", "read=skipped", "delete=skipped"}
+	if got := stepStates(report); !slices.Equal(got, want) {
+		t.Fatalf("steps %v, want %v", got, want)
+	}
+}
+
+func TestDiagnoseTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// the tcp step hangs up without a handshake
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	s := newSNIStore(t, srv, nil)
+
+	report, err := s.Diagnose(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsStep := report.Steps[2]
+	if tlsStep.Name != "tls" || tlsStep.Err != nil || !strings.HasPrefix(tlsStep.Detail, "TLS 1.3, ") {
+		t.Errorf("tls step %+v", tlsStep)
+	}
+	if len(report.Certificates) == 0 || report.Certificates[0].NotAfter.IsZero() ||
+		!strings.Contains(report.Certificates[0].Subject, "Acme Co") {
+		t.Errorf("certificates %+v, want the test server's", report.Certificates)
+	}
+}
+
+func TestDiagnoseFailures(t *testing.T) {
+	unreachable, err := newStore(map[string]string{"location": "http://" + closedPort(t), "diagnose_write": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unreachable.Close(context.Background())
+
+	broken, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}), map[string]string{"diagnose_write": "true"})
+
+	// reads come back different, the lock must still be deleted
+	var mu sync.Mutex
+	var deleted bool
+	mem := &memServer{}
+	garbled, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/resources/locks/") {
+			w.Write([]byte("something else"))
+			return
+		}
+		if r.Method == http.MethodDelete {
+			mu.Lock()
+			deleted = true
+			mu.Unlock()
+		}
+		mem.ServeHTTP(w, r)
+	}), map[string]string{"diagnose_write": "true"})
+
+	for _, test := range []struct {
+		s     *Store
+		steps []string
+		err   string
+	}{
+		{unreachable, []string{"dns=skipped", "tcp=failed", "tls=skipped", "open=skipped", "write=skipped", "read=skipped", "delete=skipped"}, "tcp: "},
+		{broken, []string{"dns=skipped", "tcp=ok", "tls=skipped", "open=failed", "write=skipped", "read=skipped", "delete=skipped"}, "open: "},
+		{garbled, []string{"dns=skipped", "tcp=ok", "tls=skipped", "open=ok", "write=ok", "read=failed", "delete=ok"}, "read: "},
+	} {
+		report, err := test.s.Diagnose(context.Background())
+		if got := stepStates(report); !slices.Equal(got, test.steps) {
+			t.Errorf("steps %v, want %v", got, test.steps)
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("got %v, want the %q step's error", err, strings.TrimSuffix(test.err, ": "))
+		}
+		if step := report.Failed(); step == nil || step.Err == nil {
+			t.Errorf("report %v tells no failed step", test.steps)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !deleted {
+		t.Error("the lock read back wrong was not deleted")
+	}
+}
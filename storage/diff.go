@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// DiffPackfiles compares the packfiles on the server with local:
+// missing are the local ones the server lacks, extra the ones only the
+// server has.  Both keep the order they came in.
+func (s *Store) DiffPackfiles(ctx context.Context, local []objects.MAC) (missing, extra []objects.MAC, err error) {
+	remote, err := s.List(ctx, storage.StorageResourcePackfile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	onServer := make(map[objects.MAC]struct{}, len(remote))
+	for _, mac := range remote {
+		onServer[mac] = struct{}{}
+	}
+	here := make(map[objects.MAC]struct{}, len(local))
+	for _, mac := range local {
+		if _, dup := here[mac]; dup {
+			continue
+		}
+		here[mac] = struct{}{}
+		if _, ok := onServer[mac]; !ok {
+			missing = append(missing, mac)
+		}
+	}
+	for _, mac := range remote {
+		if _, ok := here[mac]; !ok {
+			extra = append(extra, mac)
+			here[mac] = struct{}{}
+		}
+	}
+	return missing, extra, nil
+}
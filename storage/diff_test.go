@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestDiffPackfiles(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, &memServer{}, nil)
+	for _, mac := range []objects.MAC{{2}, {3}, {4}, {5}} {
+		if _, err := s.Put(ctx, storage.StorageResourcePackfile, mac, bytes.NewReader([]byte("packfile"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not a packfile, not in the diff
+	if _, err := s.Put(ctx, storage.StorageResourceState, objects.MAC{9}, bytes.NewReader([]byte("state"))); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, extra, err := s.DiffPackfiles(ctx, []objects.MAC{{7}, {1}, {3}, {1}, {4}, {9}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []objects.MAC{{7}, {1}, {9}}; !slices.Equal(missing, want) {
+		t.Errorf("missing %v, want %v", missing, want)
+	}
+	slices.SortFunc(extra, func(a, b objects.MAC) int { return bytes.Compare(a[:], b[:]) })
+	if want := []objects.MAC{{2}, {5}}; !slices.Equal(extra, want) {
+		t.Errorf("extra %v, want %v", extra, want)
+	}
+
+	missing, extra, err = s.DiffPackfiles(ctx, []objects.MAC{{2}, {3}, {4}, {5}})
+	if err != nil || len(missing) != 0 || len(extra) != 0 {
+		t.Errorf("same sets: missing %v, extra %v, %v", missing, extra, err)
+	}
+}
+
+func TestDiffPackfilesListError(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}), nil)
+	if _, _, err := s.DiffPackfiles(context.Background(), []objects.MAC{{1}}); err == nil {
+		t.Fatal("the listing failed, got no error")
+	}
+}
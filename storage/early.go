@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// uploadCutOff tells whether err is the server dropping the connection
+// while a body was going out.  That's usually a server that answered
+// early, say with a 413 or a 403, and stopped reading, and the answer
+// is lost along with the connection.
+func uploadCutOff(rq *request, err error) bool {
+	if rq.body == nil || rq.body.count() == 0 {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	// the transport may have closed the connection itself on seeing
+	// the reset, the write then fails on a closed one
+	partial := rq.body.size < 0 || rq.body.count() < rq.body.size
+	return partial && errors.Is(err, net.ErrClosed)
+}
+
+// withExpectContinue is rq asking the server to answer before the body
+// is sent, so that a refusal arrives as a response.
+func withExpectContinue(rq *request) *request {
+	again := *rq
+	again.header = rq.header.Clone()
+	if again.header == nil {
+		again.header = make(http.Header)
+	}
+	again.header.Set("Expect", "100-continue")
+	return &again
+}
+
+func uploadCutOffError(rq *request, err error) error {
+	return fmt.Errorf("server closed the connection after %d bytes of the upload: %w", rq.body.count(), err)
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// resetAfter reads some of the body and resets the connection, the
+// way a server that made up its mind early drops an upload.
+func resetAfter(w http.ResponseWriter, r *http.Request) {
+	io.CopyN(io.Discard, r.Body, 1024)
+	conn, _, _ := http.NewResponseController(w).Hijack()
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+}
+
+func TestUploadCutOff(t *testing.T) {
+	var mu sync.Mutex
+	var expects []string
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		expects = append(expects, r.Header.Get("Expect"))
+		mu.Unlock()
+		if r.Header.Get("Expect") == "" {
+			resetAfter(w, r)
+			return
+		}
+		http.Error(w, "packfile over quota", http.StatusRequestEntityTooLarge)
+	}), map[string]string{"max_retries": "0"})
+
+	big := bytes.Repeat([]byte("x"), 8<<20)
+	_, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader(big))
+	var se *statusErr
+	if !errors.As(err, &se) || se.status != http.StatusRequestEntityTooLarge || !strings.Contains(se.msg, "over quota") {
+		t.Fatalf("got %v, want the server's 413", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(expects) != 2 || expects[1] != "100-continue" {
+		t.Errorf("requests sent with Expect %q, want the upload asked again with 100-continue", expects)
+	}
+}
+
+func TestUploadCutOffAgain(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(resetAfter), map[string]string{"max_retries": "0"})
+
+	big := bytes.Repeat([]byte("x"), 8<<20)
+	_, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader(big))
+	if err == nil || !strings.Contains(err.Error(), "server closed the connection after") {
+		t.Fatalf("got %v, want the upload reported cut off", err)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+func parseProtocol(storeConfig map[string]string) (bool, error) {
+	switch value := storeConfig["protocol"]; value {
+	case "", "flat":
+		return false, nil
+	case "envelope":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid protocol %q: expected flat or envelope", value)
+	}
+}
+
+// decodeEnveloped decodes a JSON-RPC style {"result": ..., "error": ...}
+// reply, the result into v.  The error is a message or an object with
+// one.
+func (s *Store) decodeEnveloped(rd io.Reader, v any) error {
+	var envelope struct {
+		Result json.RawMessage `json:"result"`
+		Error  json.RawMessage `json:"error"`
+	}
+	if err := json.NewDecoder(rd).Decode(&envelope); err != nil {
+		return err
+	}
+
+	if e := bytes.TrimSpace(envelope.Error); len(e) != 0 && !bytes.Equal(e, []byte("null")) {
+		var msg string
+		if err := json.Unmarshal(e, &msg); err == nil {
+			return fmt.Errorf("%s", msg)
+		}
+		if msg, ok := errorField(e, s.errorFields); ok {
+			return fmt.Errorf("%s", msg)
+		}
+		return fmt.Errorf("%s", e)
+	}
+	if len(envelope.Result) == 0 {
+		return fmt.Errorf("reply without a result")
+	}
+	return json.Unmarshal(envelope.Result, v)
+}
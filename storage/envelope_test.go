@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// envelopeServer answers each path with the reply given for it.
+func envelopeServer(replies map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reply, ok := replies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(reply))
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	mac := objects.MAC{0xab}
+	s, _ := newTestStore(t, envelopeServer(map[string]string{
+		"/resources/states": `{"result": ["` + hex.EncodeToString(mac[:]) + `"], "error": null}`,
+		"/usage":            `{"result": {"used": 10, "free": 20}}`,
+	}), map[string]string{"protocol": "envelope"})
+	ctx := context.Background()
+
+	macs, err := s.List(ctx, storage.StorageResourceState)
+	if err != nil || !slices.Equal(macs, []objects.MAC{mac}) {
+		t.Fatalf("List: %v, %v", macs, err)
+	}
+	used, free, err := s.Usage(ctx)
+	if err != nil || used != 10 || free != 20 {
+		t.Fatalf("Usage: %d, %d, %v", used, free, err)
+	}
+}
+
+func TestEnvelopeErrors(t *testing.T) {
+	for _, test := range []struct {
+		reply string
+		want  string
+	}{
+		{`{"error": "quota exceeded"}`, "quota exceeded"},
+		{`{"result": null, "error": {"code": 7, "message": "no such tenant"}}`, "no such tenant"},
+		{`{"error": {"code": 7}}`, `{"code": 7}`},
+		{`["flat", "reply"]`, "cannot unmarshal"},
+		{`{"id": 1}`, "reply without a result"},
+	} {
+		s, _ := newTestStore(t, envelopeServer(map[string]string{"/usage": test.reply}), map[string]string{"protocol": "envelope"})
+		if _, _, err := s.Usage(context.Background()); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %q", test.reply, err, test.want)
+		}
+	}
+}
+
+func TestEnvelopeFlat(t *testing.T) {
+	s, _ := newTestStore(t, envelopeServer(map[string]string{"/usage": `{"used": 10, "free": 20}`}), nil)
+	if used, free, err := s.Usage(context.Background()); err != nil || used != 10 || free != 20 {
+		t.Fatalf("flat Usage: %d, %d, %v", used, free, err)
+	}
+
+	if _, err := newStore(map[string]string{"location": "http://localhost", "protocol": "jsonrpc"}); err == nil {
+		t.Error("an unknown protocol was accepted")
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+type objectKey struct {
+	res storage.StorageResource
+	mac objects.MAC
+}
+
+// etags remembers the last ETag the server gave for each object so that
+// ranged reads can be made conditional on the object not changing.
+type etags struct {
+	mu sync.Mutex
+	m  map[objectKey]string
+}
+
+func (e *etags) get(res storage.StorageResource, mac objects.MAC) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.m[objectKey{res, mac}]
+}
+
+func (e *etags) set(res storage.StorageResource, mac objects.MAC, etag string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := objectKey{res, mac}
+	if etag == "" {
+		delete(e.m, key)
+		return
+	}
+	if e.m == nil {
+		e.m = make(map[objectKey]string)
+	}
+	e.m[key] = etag
+}
+
+// sliceBody cuts the requested range out of a full object, which is
+// what the server sends when an If-Range no longer matches or when it
+// doesn't do ranges.
+type sliceBody struct {
+	io.Reader
+	io.Closer
+}
+
+func newSliceBody(rc io.ReadCloser, rg *storage.Range) (io.ReadCloser, error) {
+	if _, err := io.CopyN(io.Discard, rc, int64(rg.Offset)); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &sliceBody{Reader: io.LimitReader(rc, int64(rg.Length)), Closer: rc}, nil
+}
+
+// shortRangeBody catches a ranged read ending before the length asked
+// for, which would otherwise go unnoticed and corrupt a restore.  The
+// missing tail is either fetched with another ranged request or the
+// read fails.  Whatever comes past the length is left unread.
+type shortRangeBody struct {
+	ctx context.Context
+	s   *Store
+	res storage.StorageResource
+	mac objects.MAC
+	rg  storage.Range
+	rc  io.ReadCloser
+	n   int64
+
+	// read since the last continuation, one that brings nothing
+	// is not retried
+	progress int64
+}
+
+func (b *shortRangeBody) Read(p []byte) (int, error) {
+	left := int64(b.rg.Length) - b.n
+	if left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
+	for {
+		k, err := b.rc.Read(p)
+		b.n += int64(k)
+		b.progress += int64(k)
+		if err != io.EOF || b.n >= int64(b.rg.Length) {
+			return k, err
+		}
+		if k > 0 {
+			// report the data first, the next read continues
+			return k, nil
+		}
+		if c, ok := b.rc.(*clampedBody); ok && b.progress >= c.length {
+			return 0, io.EOF
+		}
+
+		if !b.s.continueShortRanges || b.progress == 0 {
+			return 0, fmt.Errorf("short read: got %d of the %d bytes at offset %d: %w",
+				b.n, b.rg.Length, b.rg.Offset, io.ErrUnexpectedEOF)
+		}
+		b.rc.Close()
+		tail := &storage.Range{Offset: b.rg.Offset + uint64(b.n), Length: b.rg.Length - uint32(b.n)}
+		rc, err := b.s.get(b.ctx, b.res, b.mac, tail)
+		if err != nil {
+			b.rc = io.NopCloser(bytes.NewReader(nil))
+			return 0, err
+		}
+		b.rc = rc
+		b.progress = 0
+	}
+}
+
+func (b *shortRangeBody) Close() error {
+	return b.rc.Close()
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// objectServer serves a single object honoring Range and If-Range, or
+// ignoring Range when noRanges is set.
+type objectServer struct {
+	mu       sync.Mutex
+	data     []byte
+	etag     string
+	noRanges bool
+	statuses []int
+}
+
+func (o *objectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.noRanges {
+		r.Header.Del("Range")
+	}
+	w.Header().Set("ETag", o.etag)
+	rw := &statusRecorder{ResponseWriter: w}
+	http.ServeContent(rw, r, "", time.Time{}, bytes.NewReader(o.data))
+	o.statuses = append(o.statuses, rw.status)
+}
+
+func (o *objectServer) set(data, etag string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.data, o.etag = []byte(data), etag
+}
+
+func (o *objectServer) lastStatus() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.statuses[len(o.statuses)-1]
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rw *statusRecorder) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *statusRecorder) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+func readRange(t *testing.T, s *Store, offset uint64, length uint32) string {
+	t.Helper()
+	rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, &storage.Range{Offset: offset, Length: length})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestIfRange(t *testing.T) {
+	obj := &objectServer{}
+	obj.set("0123456789abcdef", `"v1"`)
+	s, _ := newTestStore(t, obj, nil)
+
+	// learn the ETag
+	if got := readRange(t, s, 0, 4); got != "0123" {
+		t.Fatalf("got %q, want 0123", got)
+	}
+
+	if got := readRange(t, s, 2, 4); got != "2345" {
+		t.Errorf("unchanged object: got %q, want 2345", got)
+	}
+	if status := obj.lastStatus(); status != http.StatusPartialContent {
+		t.Errorf("unchanged object answered with %d, want 206", status)
+	}
+
+	obj.set("ABCDEFGHIJKLMNOP", `"v2"`)
+	if got := readRange(t, s, 2, 4); got != "CDEF" {
+		t.Errorf("changed object: got %q, want CDEF", got)
+	}
+	if status := obj.lastStatus(); status != http.StatusOK {
+		t.Errorf("changed object answered with %d, want 200", status)
+	}
+}
+
+func TestRangeIgnored(t *testing.T) {
+	obj := &objectServer{noRanges: true}
+	obj.set("0123456789abcdef", "")
+	s, _ := newTestStore(t, obj, nil)
+
+	if got := readRange(t, s, 2, 4); got != "2345" {
+		t.Errorf("got %q, want 2345", got)
+	}
+}
+
+func TestRangeTooLong(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, "23456789")
+	}), nil)
+
+	if got := readRange(t, s, 2, 4); got != "2345" {
+		t.Errorf("got %q, want 2345", got)
+	}
+}
+
+// deleteServer holds a packfile under an ETag, deleting it only if
+// If-Match, when sent, matches.
+type deleteServer struct {
+	mu      sync.Mutex
+	etag    string
+	ifMatch []string
+}
+
+func (d *deleteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("ETag", d.etag)
+		w.Write([]byte("packfile"))
+	case http.MethodDelete:
+		d.ifMatch = append(d.ifMatch, r.Header.Get("If-Match"))
+		if m := r.Header.Get("If-Match"); m != "" && m != d.etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}
+	}
+}
+
+func (d *deleteServer) replace(etag string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.etag = etag
+}
+
+func TestConditionalDelete(t *testing.T) {
+	srv := &deleteServer{etag: `"v1"`}
+	s, _ := newTestStore(t, srv, map[string]string{"conditional_delete": "true"})
+	ctx := context.Background()
+	get := func() {
+		rd, err := s.Get(ctx, storage.StorageResourcePackfile, objects.MAC{1}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, rd)
+		rd.Close()
+	}
+
+	get()
+	srv.replace(`"v2"`)
+	if err := s.Delete(ctx, storage.StorageResourcePackfile, objects.MAC{1}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("delete of a replaced packfile: got %v, want ErrPreconditionFailed", err)
+	}
+	get()
+	if err := s.Delete(ctx, storage.StorageResourcePackfile, objects.MAC{1}); err != nil {
+		t.Errorf("delete of the packfile as last seen: %v", err)
+	}
+	// never seen, nothing to compare to
+	if err := s.Delete(ctx, storage.StorageResourcePackfile, objects.MAC{2}); err != nil {
+		t.Error(err)
+	}
+	if want := []string{`"v1"`, `"v2"`, ""}; !slices.Equal(srv.ifMatch, want) {
+		t.Errorf("deletes sent If-Match %q, want %q", srv.ifMatch, want)
+	}
+}
+
+func TestConditionalDeleteOff(t *testing.T) {
+	srv := &deleteServer{etag: `"v1"`}
+	s, _ := newTestStore(t, srv, nil)
+
+	rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	srv.replace(`"v2"`)
+	if err := s.Delete(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(srv.ifMatch, []string{""}) {
+		t.Errorf("sent If-Match %q without conditional_delete", srv.ifMatch)
+	}
+}
+
+// shortRangeServer answers a range with at most max bytes of it.
+type shortRangeServer struct {
+	data []byte
+	max  int
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (h *shortRangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.ranges = append(h.ranges, r.Header.Get("Range"))
+	h.mu.Unlock()
+
+	var first, last int
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last); err != nil || first >= len(h.data) {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	last = min(last, first+h.max-1, len(h.data)-1)
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(h.data)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(h.data[first : last+1])
+}
+
+func TestShortRangeContinue(t *testing.T) {
+	h := &shortRangeServer{data: []byte("abcdefghijklmnopqrstuvwxyz"), max: 6}
+	s, _ := newTestStore(t, h, map[string]string{"short_range": "continue"})
+
+	if data := readRange(t, s, 3, 20); data != "defghijklmnopqrstuvw" {
+		t.Fatalf("got %q, want the 20 bytes at offset 3", data)
+	}
+	want := []string{"bytes=3-22", "bytes=9-22", "bytes=15-22", "bytes=21-22"}
+	if !slices.Equal(h.ranges, want) {
+		t.Errorf("asked for %v, want %v", h.ranges, want)
+	}
+}
+
+func TestShortRangeError(t *testing.T) {
+	h := &shortRangeServer{data: []byte("abcdefghijklmnopqrstuvwxyz"), max: 6}
+	s, _ := newTestStore(t, h, nil)
+
+	rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, &storage.Range{Offset: 3, Length: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), "got 6 of the 20 bytes at offset 3") {
+		t.Fatalf("short range: got %q, %v, want the read to fail", data, err)
+	}
+	if len(h.ranges) != 1 {
+		t.Errorf("%d requests, want the missing tail left alone", len(h.ranges))
+	}
+}
+
+func TestShortRangeConfig(t *testing.T) {
+	if _, err := newStore(map[string]string{"location": "http://localhost", "short_range": "retry"}); err == nil {
+		t.Error("an unknown short_range was accepted")
+	}
+}
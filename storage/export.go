@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// ExportAll streams every packfile and state of the repository as one
+// tar archive built by the server, for bulk migrations.  ErrUnsupported
+// means the server can't, and the objects have to be fetched one by
+// one.  The caller must close the archive.
+func (s *Store) ExportAll(ctx context.Context) (io.ReadCloser, error) {
+	r, err := s.sendRequest(withObjectFetch(ctx), &request{
+		op:     opGet,
+		method: "GET",
+		path:   "/export",
+		header: http.Header{"Accept": {"application/x-tar"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if isUnsupported(r.StatusCode) {
+		r.Body.Close()
+		return nil, ErrUnsupported
+	}
+	if r.StatusCode != http.StatusOK {
+		defer r.Body.Close()
+		return nil, s.statusError(r)
+	}
+	if s.strictContentType {
+		if err := checkContentType(r, "application/x-tar"); err != nil {
+			r.Body.Close()
+			return nil, err
+		}
+	}
+	return s.downloadLimiter.readCloser(ctx, r.Body), nil
+}
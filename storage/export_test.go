@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"testing"
+)
+
+func TestExportAll(t *testing.T) {
+	files := map[string]string{
+		"packfiles/01": "first packfile",
+		"packfiles/02": "second packfile",
+		"states/0a":    "a state",
+	}
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/export" || r.Header.Get("Accept") != "application/x-tar" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		tw := tar.NewWriter(w)
+		for _, name := range []string{"packfiles/01", "packfiles/02", "states/0a"} {
+			tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(files[name]))})
+			io.WriteString(tw, files[name])
+		}
+		tw.Close()
+	}), map[string]string{"strict_content_type": "true"})
+
+	rd, err := s.ExportAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+
+	got := map[string]string{}
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(data)
+	}
+	if !maps.Equal(got, files) {
+		t.Errorf("archive holds %q, want %q", got, files)
+	}
+}
+
+func TestExportAllUnsupported(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented} {
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}), nil)
+		if _, err := s.ExportAll(context.Background()); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%d: got %v, want ErrUnsupported", status, err)
+		}
+	}
+
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("export not allowed"))
+	}), nil)
+	if _, err := s.ExportAll(context.Background()); err == nil || err.Error() != "export not allowed" {
+		t.Errorf("403: got %v, want the server's error", err)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// faultInjectionEnv must be set for the debug_fault_injection_* keys to
+// be accepted at all, so that a stray config can't break a production
+// setup.
+const faultInjectionEnv = "PLAKAR_HTTP_FAULT_INJECTION"
+
+var errInjectedFault = fmt.Errorf("injected fault")
+
+// faultInjector delays or fails a fraction of the requests, to exercise
+// the error handling of a setup.
+type faultInjector struct {
+	next  http.RoundTripper
+	clock clock
+	rand  *jitter
+	rate  float64
+	delay time.Duration
+}
+
+func parseFaultInjection(storeConfig map[string]string) (float64, time.Duration, error) {
+	value, hasRate := storeConfig["debug_fault_injection_rate"]
+	_, hasDelay := storeConfig["debug_fault_injection_delay"]
+	if !hasRate && !hasDelay {
+		return 0, 0, nil
+	}
+	if os.Getenv(faultInjectionEnv) != "1" {
+		return 0, 0, fmt.Errorf("debug_fault_injection_* requires %s=1 in the environment", faultInjectionEnv)
+	}
+
+	if !hasRate {
+		return 0, 0, fmt.Errorf("debug_fault_injection_delay requires debug_fault_injection_rate")
+	}
+
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, 0, fmt.Errorf("invalid debug_fault_injection_rate %q: expected a number between 0 and 1", value)
+	}
+	delay, err := parseDuration(storeConfig, "debug_fault_injection_delay")
+	if err != nil {
+		return 0, 0, err
+	}
+	return rate, delay, nil
+}
+
+func (f *faultInjector) RoundTrip(req *http.Request) (*http.Response, error) {
+	if f.rand.float() >= f.rate {
+		return f.next.RoundTrip(req)
+	}
+
+	// with a delay configured, half the faults are slow requests
+	// rather than failed ones.
+	if f.delay > 0 && f.rand.float() < 0.5 {
+		if err := sleepContext(req.Context(), f.clock, f.rand.n(f.delay)); err != nil {
+			return nil, err
+		}
+		return f.next.RoundTrip(req)
+	}
+
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, errInjectedFault
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/zeebo/blake3"
+)
+
+// integrityAlgo is how object digests exchanged with the server are
+// computed: the one sent with an upload, the one it sends with a 409 on
+// upload, and the one it sends as a trailer of a download.
+type integrityAlgo struct {
+	header string
+	new    func() hash.Hash
+}
+
+var integrityAlgos = map[string]integrityAlgo{
+	"sha256": {header: "X-Content-Sha256", new: sha256.New},
+	"crc32c": {header: "X-Content-Crc32c", new: func() hash.Hash {
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}},
+	"blake3": {header: "X-Content-Blake3", new: func() hash.Hash {
+		return blake3.New()
+	}},
+}
+
+func parseIntegrityAlgo(storeConfig map[string]string) (integrityAlgo, error) {
+	value, ok := storeConfig["integrity_algo"]
+	if !ok {
+		value = "sha256"
+	}
+	algo, ok := integrityAlgos[value]
+	if !ok {
+		return algo, fmt.Errorf("invalid integrity_algo %q: expected sha256, crc32c or blake3", value)
+	}
+	return algo, nil
+}
+
+// verifyWrite checks, after an upload that had to be retried, that the
+// server holds the object exactly as sent: an attempt reported failed
+// may have landed all the same, or only in part.  The digest is only
+// compared when the server reports one.
+func (s *Store) verifyWrite(ctx context.Context, uri string, body *requestBody) error {
+	r, err := s.sendRequest(ctx, &request{op: opGet, method: "HEAD", path: uri})
+	if err != nil {
+		return fmt.Errorf("verifying retried write: %w", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("verifying retried write: %w", s.statusError(r))
+	}
+	if remote := r.Header.Get(s.integrity.header); remote != "" &&
+		!strings.EqualFold(remote, hex.EncodeToString(body.sum())) {
+		return fmt.Errorf("verifying retried write: server holds a different object, %s %s", s.integrity.header, remote)
+	}
+	return nil
+}
+
+// digestTrailer fills the digest trailer of a request in once the body
+// is read to the end, as net/http wants it.
+type digestTrailer struct {
+	rd      io.Reader
+	body    *requestBody
+	trailer http.Header
+	key     string
+}
+
+func (d *digestTrailer) Read(p []byte) (int, error) {
+	n, err := d.rd.Read(p)
+	if err == io.EOF {
+		d.trailer.Set(d.key, hex.EncodeToString(d.body.sum()))
+	}
+	return n, err
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// digestServer checks the digest of every upload against its body, and
+// sends one back as a trailer of every download.
+func digestServer(t *testing.T, algo integrityAlgo, where *string) http.HandlerFunc {
+	var stored []byte
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			var body io.Reader = r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body = zr
+			}
+			data, _ := io.ReadAll(body)
+			h := algo.new()
+			h.Write(data)
+			want := hex.EncodeToString(h.Sum(nil))
+
+			*where = ""
+			if got := r.Header.Get(algo.header); got != "" {
+				*where = "header"
+				if got != want {
+					t.Errorf("%s header %s, want %s", algo.header, got, want)
+				}
+			}
+			if got := r.Trailer.Get(algo.header); got != "" {
+				*where = "trailer"
+				if got != want {
+					t.Errorf("%s trailer %s, want %s", algo.header, got, want)
+				}
+			}
+			stored = data
+		case "GET":
+			w.Header().Set("Trailer", algo.header)
+			w.Write(stored)
+			h := algo.new()
+			h.Write(stored)
+			w.Header().Set(algo.header, hex.EncodeToString(h.Sum(nil)))
+		}
+	}
+}
+
+func TestIntegrityAlgos(t *testing.T) {
+	data := []byte(strings.Repeat("some state ", 100))
+	for name, algo := range integrityAlgos {
+		for _, test := range []struct {
+			how    string
+			config map[string]string
+			rd     func() io.Reader
+			where  string
+		}{
+			{"seekable", nil, func() io.Reader { return bytes.NewReader(data) }, "header"},
+			{"stream", nil, func() io.Reader { return io.MultiReader(bytes.NewReader(data)) }, "trailer"},
+			{"compressed", map[string]string{"compress_states": "true"}, func() io.Reader { return bytes.NewReader(data) }, "header"},
+		} {
+			t.Run(name+" "+test.how, func(t *testing.T) {
+				var where string
+				config := map[string]string{"integrity_algo": name}
+				for k, v := range test.config {
+					config[k] = v
+				}
+				s, _ := newTestStore(t, digestServer(t, algo, &where), config)
+
+				if _, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, test.rd()); err != nil {
+					t.Fatal(err)
+				}
+				if where != test.where {
+					t.Errorf("digest sent as %q, want %q", where, test.where)
+				}
+
+				rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer rd.Close()
+				got, err := io.ReadAll(rd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("read back %d bytes, want %d", len(got), len(data))
+				}
+			})
+		}
+	}
+}
+
+func TestIntegrityTrailerMismatch(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Content-Sha256")
+		io.WriteString(w, "some state")
+		w.Header().Set("X-Content-Sha256", strings.Repeat("00", 32))
+	}), nil)
+
+	rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	if _, err := io.ReadAll(rd); err == nil {
+		t.Error("object read despite a digest mismatch")
+	}
+}
+
+func TestIntegrityAlgoInvalid(t *testing.T) {
+	if _, err := parseIntegrityAlgo(map[string]string{"integrity_algo": "md5"}); err == nil {
+		t.Error("integrity_algo=md5 accepted")
+	}
+}
+
+// retriedServer keeps each state upload once per idempotency key, and
+// holds the first answer past the client's read timeout.  corrupt
+// has it keep something else than it got.
+type retriedServer struct {
+	corrupt bool
+
+	mu     sync.Mutex
+	keys   map[string]bool
+	writes int
+	heads  int
+	stored []byte
+}
+
+func (rs *retriedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, _ := io.ReadAll(r.Body)
+	rs.mu.Lock()
+	switch r.Method {
+	case http.MethodPut:
+		key := r.Header.Get(idempotencyHeader)
+		if rs.keys == nil {
+			rs.keys = make(map[string]bool)
+		}
+		if rs.keys[key] {
+			rs.mu.Unlock()
+			return
+		}
+		rs.keys[key] = true
+		rs.writes++
+		rs.stored = data
+		if rs.corrupt {
+			rs.stored = data[:len(data)/2]
+		}
+		first := rs.writes == 1
+		rs.mu.Unlock()
+		if first {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return
+	case http.MethodHead:
+		rs.heads++
+		sum := sha256.Sum256(rs.stored)
+		w.Header().Set("X-Content-Sha256", hex.EncodeToString(sum[:]))
+	}
+	rs.mu.Unlock()
+}
+
+func TestVerifyRetriedStates(t *testing.T) {
+	for _, test := range []struct {
+		verify  string
+		corrupt bool
+		heads   int
+		fails   bool
+	}{
+		{"true", false, 1, false},
+		{"true", true, 1, true},
+		{"false", false, 0, false},
+	} {
+		rs := &retriedServer{corrupt: test.corrupt}
+		s, _ := newTestStore(t, rs, map[string]string{"verify_retried_states": test.verify, "read_timeout": "50ms"})
+
+		_, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, strings.NewReader("the state to write once"))
+		if test.fails && (err == nil || !strings.Contains(err.Error(), "server holds a different object")) {
+			t.Errorf("verify %s, corrupt %v: got %v, want the mismatch reported", test.verify, test.corrupt, err)
+		} else if !test.fails && err != nil {
+			t.Errorf("verify %s, corrupt %v: %v", test.verify, test.corrupt, err)
+		}
+
+		rs.mu.Lock()
+		if rs.writes != 1 || rs.heads != test.heads {
+			t.Errorf("verify %s, corrupt %v: %d writes and %d checks, want 1 and %d",
+				test.verify, test.corrupt, rs.writes, rs.heads, test.heads)
+		}
+		rs.mu.Unlock()
+	}
+}
+
+func TestVerifyRetriedStatesNotRetried(t *testing.T) {
+	var heads atomic.Int32
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+	}), map[string]string{"verify_retried_states": "true"})
+
+	if _, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, strings.NewReader("state")); err != nil {
+		t.Fatal(err)
+	}
+	if n := heads.Load(); n != 0 {
+		t.Errorf("upload that went through at once checked %d times, want none", n)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maintenanceHeader = "X-Maintenance"
+
+// maxMaintenanceWait is the longest maintenance window waited out, the
+// caller is told about longer ones right away.
+const maxMaintenanceWait = 10 * time.Minute
+
+var ErrMaintenance = fmt.Errorf("server is in maintenance")
+
+// maintenanceWindow tells whether r announces a scheduled maintenance
+// and for how long, 0 if the server didn't say.
+func (s *Store) maintenanceWindow(r *http.Response) (time.Duration, bool) {
+	if r.StatusCode != http.StatusServiceUnavailable || !strings.EqualFold(r.Header.Get(maintenanceHeader), "true") {
+		return 0, false
+	}
+
+	value := r.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(s.clock.Now()), 0), true
+	}
+	return 0, true
+}
+
+func maintenanceError(window time.Duration) error {
+	if window == 0 {
+		return ErrMaintenance
+	}
+	return fmt.Errorf("%w, retry in %s", ErrMaintenance, window.Round(time.Second))
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// maintenanceHandler announces a maintenance with retryAfter to the
+// first failures requests, then answers 200.
+func maintenanceHandler(retryAfter string, failures int32, hits *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if hits.Add(1) <= failures {
+			w.Header().Set(maintenanceHeader, "true")
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func putStateAsync(s *Store) chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("state")))
+		done <- err
+	}()
+	return done
+}
+
+func TestMaintenanceWaited(t *testing.T) {
+	var hits atomic.Int32
+	clk := newFakeClock()
+	s, _ := newTestStoreClock(t, maintenanceHandler("120", 1, &hits), nil, clk)
+	logs := &logRecorder{}
+	s.logger = slog.New(logs)
+
+	done := putStateAsync(s)
+	if d := clk.nextWait(t); d != 2*time.Minute {
+		t.Fatalf("waited %s for a 2 minutes maintenance", d)
+	}
+	clk.Advance(2 * time.Minute)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	if len(logs.records) != 1 || logs.records[0].Message != "server in maintenance, waiting" {
+		t.Fatalf("logged %v, want the maintenance once", logs.records)
+	}
+}
+
+func TestMaintenanceWaitedOnce(t *testing.T) {
+	var hits atomic.Int32
+	clk := newFakeClock()
+	s, _ := newTestStoreClock(t, maintenanceHandler("60", 5, &hits), map[string]string{"max_retries": "5"}, clk)
+	s.logger = slog.New(slog.DiscardHandler)
+
+	done := putStateAsync(s)
+	clk.Advance(clk.nextWait(t))
+	err := <-done
+	if !errors.Is(err, ErrMaintenance) || !strings.Contains(err.Error(), "retry in 1m0s") {
+		t.Fatalf("maintenance still on after its window: got %v, want ErrMaintenance", err)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("%d requests, want 2: the maintenance is waited out once, not retried", n)
+	}
+}
+
+func TestMaintenanceNotWaited(t *testing.T) {
+	for _, retryAfter := range []string{"", "3600"} {
+		var hits atomic.Int32
+		clk := newFakeClock()
+		s, _ := newTestStoreClock(t, maintenanceHandler(retryAfter, 1, &hits), nil, clk)
+
+		err := <-putStateAsync(s)
+		if !errors.Is(err, ErrMaintenance) {
+			t.Errorf("Retry-After %q: got %v, want ErrMaintenance", retryAfter, err)
+		}
+		if n := hits.Load(); n != 1 {
+			t.Errorf("Retry-After %q: %d requests, want 1", retryAfter, n)
+		}
+		select {
+		case d := <-clk.waits:
+			t.Errorf("Retry-After %q: waited %s", retryAfter, d)
+		default:
+		}
+	}
+}
+
+func TestMaintenanceHeaderOnly503(t *testing.T) {
+	var hits atomic.Int32
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if hits.Add(1) == 1 {
+			w.Header().Set(maintenanceHeader, "true")
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}), nil)
+
+	if err := <-putStateAsync(s); err != nil {
+		t.Fatalf("502 with %s: %v, want it retried as usual", maintenanceHeader, err)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func parseMethod(storeConfig map[string]string, key string) (string, error) {
+	value, ok := storeConfig[key]
+	if !ok {
+		return http.MethodPut, nil
+	}
+	switch method := strings.ToUpper(value); method {
+	case http.MethodPut, http.MethodPost, http.MethodPatch:
+		return method, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q, expected PUT, POST or PATCH", key, value)
+	}
+}
+
+// existing remembers the objects known to be on the server, for the
+// servers that want a different verb to overwrite one.
+type existing struct {
+	mu sync.Mutex
+	m  map[objectKey]struct{}
+}
+
+func (e *existing) has(res storage.StorageResource, mac objects.MAC) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.m[objectKey{res, mac}]
+	return ok
+}
+
+func (e *existing) set(res storage.StorageResource, mac objects.MAC, exists bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := objectKey{res, mac}
+	if !exists {
+		delete(e.m, key)
+		return
+	}
+	if e.m == nil {
+		e.m = make(map[objectKey]struct{})
+	}
+	e.m[key] = struct{}{}
+}
+
+// putMethod picks the verb to upload an object with: the update one if
+// it is known to exist, the create one otherwise.
+func (s *Store) putMethod(res storage.StorageResource, mac objects.MAC) string {
+	if s.createMethod != s.updateMethod && s.existing.has(res, mac) {
+		return s.updateMethod
+	}
+	return s.createMethod
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// restServer creates with POST and overwrites with PUT, refusing
+// either on the wrong side of the object's existence.
+type restServer struct {
+	mu      sync.Mutex
+	objects map[string]bool
+	log     []string
+}
+
+func (rs *restServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.objects == nil {
+		rs.objects = make(map[string]bool)
+	}
+	id := path.Base(r.URL.Path)
+	if r.Method != http.MethodGet {
+		rs.log = append(rs.log, r.Method+" "+id[:2])
+	}
+	switch r.Method {
+	case http.MethodGet:
+		macs := []objects.MAC{}
+		for id := range rs.objects {
+			var mac objects.MAC
+			b, _ := hex.DecodeString(id)
+			copy(mac[:], b)
+			macs = append(macs, mac)
+		}
+		json.NewEncoder(w).Encode(macs)
+	case http.MethodPost:
+		if rs.objects[id] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		rs.objects[id] = true
+	case http.MethodPut:
+		if !rs.objects[id] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case http.MethodDelete:
+		delete(rs.objects, id)
+	}
+}
+
+func (rs *restServer) requests() []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	ret := rs.log
+	rs.log = nil
+	return ret
+}
+
+func TestCreateUpdateMethods(t *testing.T) {
+	srv := &restServer{}
+	config := map[string]string{"create_method": "post", "update_method": "PUT", "max_retries": "0"}
+	s, _ := newTestStore(t, srv, config)
+	ctx := context.Background()
+	put := func(s *Store, mac objects.MAC) {
+		t.Helper()
+		if _, err := s.Put(ctx, storage.StorageResourcePackfile, mac, bytes.NewReader([]byte("packfile"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(what string, want ...string) {
+		t.Helper()
+		if got := srv.requests(); !slices.Equal(got, want) {
+			t.Errorf("%s: server got %q, want %q", what, got, want)
+		}
+	}
+
+	put(s, objects.MAC{1})
+	check("first write", "POST 01")
+	put(s, objects.MAC{1})
+	check("overwrite", "PUT 01")
+
+	// a store that never saw it learns it exists from the conflict
+	other, _ := newTestStore(t, srv, config)
+	put(other, objects.MAC{1})
+	check("overwrite by another store", "POST 01", "PUT 01")
+
+	// or from a listing
+	put(s, objects.MAC{2})
+	srv.requests()
+	if _, err := other.List(ctx, storage.StorageResourcePackfile); err != nil {
+		t.Fatal(err)
+	}
+	put(other, objects.MAC{2})
+	check("overwrite of a listed packfile", "PUT 02")
+
+	if err := s.Delete(ctx, storage.StorageResourcePackfile, objects.MAC{1}); err != nil {
+		t.Fatal(err)
+	}
+	put(s, objects.MAC{1})
+	check("write after a delete", "DELETE 01", "POST 01")
+}
+
+func TestCreateUpdateMethodsInvalid(t *testing.T) {
+	for _, key := range []string{"create_method", "update_method"} {
+		if err := ValidateConfig(map[string]string{"location": "http://example.com", key: "GET"}); err == nil {
+			t.Errorf("%s=GET accepted", key)
+		}
+	}
+}
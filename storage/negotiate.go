@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// NegotiateProvider produces SPNEGO tokens for authenticating to a
+// proxy, usually from the system's Kerberos credentials.  challenge is
+// the token the proxy sent along with its Negotiate challenge, nil when
+// authenticating up front.
+type NegotiateProvider interface {
+	Token(ctx context.Context, proxy *url.URL, challenge []byte) ([]byte, error)
+}
+
+var (
+	negotiateMu       sync.Mutex
+	negotiateProvider NegotiateProvider
+)
+
+// SetNegotiateProvider installs the provider used by the stores
+// configured with proxy_auth=negotiate.  This package ships none, as
+// it would tie it to a Kerberos implementation.
+func SetNegotiateProvider(p NegotiateProvider) {
+	negotiateMu.Lock()
+	defer negotiateMu.Unlock()
+	negotiateProvider = p
+}
+
+func getNegotiateProvider() NegotiateProvider {
+	negotiateMu.Lock()
+	defer negotiateMu.Unlock()
+	return negotiateProvider
+}
+
+func parseProxyAuth(storeConfig map[string]string) (NegotiateProvider, error) {
+	switch value := storeConfig["proxy_auth"]; value {
+	case "", "none":
+		return nil, nil
+	case "negotiate":
+		p := getNegotiateProvider()
+		if p == nil {
+			return nil, fmt.Errorf("proxy_auth=negotiate but no negotiate provider is installed")
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("invalid proxy_auth %q: expected none or negotiate", value)
+	}
+}
+
+// negotiateChallenge returns the token of a Negotiate challenge in a
+// 407, ok is false if the proxy asked for something else.
+func negotiateChallenge(r *http.Response) (challenge []byte, ok bool) {
+	for _, v := range r.Header.Values("Proxy-Authenticate") {
+		scheme, param, _ := strings.Cut(v, " ")
+		if !strings.EqualFold(scheme, "Negotiate") {
+			continue
+		}
+		param = strings.TrimSpace(param)
+		if param == "" {
+			return nil, true
+		}
+		challenge, err := base64.StdEncoding.DecodeString(param)
+		if err != nil {
+			return nil, false
+		}
+		return challenge, true
+	}
+	return nil, false
+}
+
+func negotiateHeader(token []byte) string {
+	return "Negotiate " + base64.StdEncoding.EncodeToString(token)
+}
+
+// proxyFor is the proxy the transport would go through for a request
+// to u, nil if none.
+func proxyFor(tr *http.Transport, u *url.URL) *url.URL {
+	if tr.Proxy == nil {
+		return nil
+	}
+	proxy, err := tr.Proxy(&http.Request{URL: u})
+	if err != nil {
+		return nil
+	}
+	return proxy
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// fakeNegotiate answers a challenge with "answer to " the challenge.
+type fakeNegotiate struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeNegotiate) Token(ctx context.Context, proxy *url.URL, challenge []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, proxy.Host+" "+string(challenge))
+	return []byte("answer to " + string(challenge)), nil
+}
+
+func TestNegotiateProxy(t *testing.T) {
+	provider := &fakeNegotiate{}
+	SetNegotiateProvider(provider)
+	t.Cleanup(func() { SetNegotiateProvider(nil) })
+
+	want := "Negotiate " + base64.StdEncoding.EncodeToString([]byte("answer to proxy challenge"))
+	var origin []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != want {
+			w.Header().Set("Proxy-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString([]byte("proxy challenge")))
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		// the proxy is the origin too, that is enough to tell what
+		// went through
+		origin = append(origin, r.URL.String())
+	}))
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	s, err := newStore(map[string]string{"location": "http://storage.example/repo", "proxy_auth": "negotiate", "max_retries": "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close(context.Background()) })
+	s.transport.Proxy = http.ProxyURL(proxyURL)
+
+	rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+
+	if len(origin) != 1 || !strings.HasPrefix(origin[0], "http://storage.example/repo/resources/states/") {
+		t.Errorf("went through the proxy to %q, want the state", origin)
+	}
+	if len(provider.calls) != 1 || provider.calls[0] != proxyURL.Host+" proxy challenge" {
+		t.Errorf("provider called with %q, want the proxy's challenge once", provider.calls)
+	}
+}
+
+func TestNegotiateNoProvider(t *testing.T) {
+	SetNegotiateProvider(nil)
+	_, err := newStore(map[string]string{"location": "http://storage.example/repo", "proxy_auth": "negotiate"})
+	if err == nil || !strings.Contains(err.Error(), "no negotiate provider") {
+		t.Errorf("got %v, want the missing provider reported", err)
+	}
+}
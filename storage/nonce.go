@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"net/http"
+	"sync"
+)
+
+const (
+	nonceHeader = "X-Nonce"
+
+	// not in net/http, this is what gateways use to flag an expired
+	// anti-replay token.
+	statusNonceExpired = 419
+)
+
+// nonces holds the anti-replay token echoed on mutating requests.  The
+// server may hand out a new one on any response, the latest one wins.
+type nonces struct {
+	endpoint string
+
+	mu    sync.Mutex
+	value string
+}
+
+func (n *nonces) get() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.value
+}
+
+func (n *nonces) update(r *http.Response) {
+	if v := r.Header.Get(nonceHeader); v != "" {
+		n.mu.Lock()
+		n.value = v
+		n.mu.Unlock()
+	}
+}
+
+func (n *nonces) reset() {
+	n.mu.Lock()
+	n.value = ""
+	n.mu.Unlock()
+}
+
+// mutating tells the requests changing something on the server, which
+// is down to the operation: a read may well be a POST.
+func (rq *request) mutating() bool {
+	switch rq.op {
+	case opPut, opPatch, opDelete, opTransaction:
+		return true
+	default:
+		return false
+	}
+}
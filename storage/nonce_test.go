@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// nonceServer hands out nonces on /nonce and only accepts writes
+// carrying the latest one.  Reads must come without.
+type nonceServer struct {
+	mu     sync.Mutex
+	issued int
+	value  string
+	stale  bool // every nonce is expired on arrival
+	puts   int
+	errs   []string
+}
+
+func (n *nonceServer) expire() {
+	n.mu.Lock()
+	n.value = "expired"
+	n.mu.Unlock()
+}
+
+func (n *nonceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	got := r.Header.Get(nonceHeader)
+	switch {
+	case r.URL.Path == "/nonce":
+		n.issued++
+		n.value = strconv.Itoa(n.issued)
+		w.Header().Set(nonceHeader, n.value)
+	case r.Method == http.MethodGet:
+		if got != "" {
+			n.errs = append(n.errs, "nonce sent on a read of "+r.URL.Path)
+		}
+	case got == "" || got != n.value || n.stale:
+		w.WriteHeader(statusNonceExpired)
+	default:
+		n.puts++
+	}
+}
+
+func TestNoncePut(t *testing.T) {
+	srv := &nonceServer{}
+	s, _ := newTestStore(t, srv, map[string]string{"nonce_endpoint": "/nonce"})
+	put := func() error {
+		_, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader([]byte("packfile")))
+		return err
+	}
+
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(); err != nil {
+		t.Fatal(err)
+	}
+	if srv.issued != 1 {
+		t.Errorf("fetched %d nonces for two writes, want the first one reused", srv.issued)
+	}
+
+	srv.expire()
+	if err := put(); err != nil {
+		t.Fatalf("write after the nonce expired: %v", err)
+	}
+	if srv.issued != 2 || srv.puts != 3 {
+		t.Errorf("fetched %d nonces and stored %d packfiles, want 2 and 3", srv.issued, srv.puts)
+	}
+
+	rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	for _, e := range srv.errs {
+		t.Error(e)
+	}
+}
+
+func TestNonceSingleRetry(t *testing.T) {
+	srv := &nonceServer{stale: true}
+	s, _ := newTestStore(t, srv, map[string]string{"nonce_endpoint": "/nonce", "max_retries": "0"})
+
+	_, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader([]byte("packfile")))
+	if err == nil {
+		t.Fatal("write went through with an expired nonce")
+	}
+	if srv.issued != 2 {
+		t.Errorf("fetched %d nonces, want the initial one and a single refresh", srv.issued)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// PatchState applies patch to the state mac in place on the server.  If
+// the server can't PATCH, the whole state returned by full is uploaded
+// instead and the server isn't asked to PATCH again.
+func (s *Store) PatchState(ctx context.Context, mac objects.MAC, patch []byte, full func() (io.Reader, error)) error {
+	if !s.patchUnsupported.Load() {
+		uri := fmt.Sprintf("/resources/%s/%016x", strres(storage.StorageResourceState), mac)
+		r, err := s.sendRequest(ctx, &request{
+			op:     opPatch,
+			method: "PATCH",
+			path:   uri,
+			body:   newRequestBody(bytes.NewReader(patch), nil),
+		})
+		if err != nil {
+			s.audit(opPatch, storage.StorageResourceState, mac, int64(len(patch)), err)
+			return err
+		}
+		defer r.Body.Close()
+
+		switch r.StatusCode {
+		case http.StatusOK, http.StatusNoContent:
+			s.stateCache.forget(storage.StorageResourceState, mac)
+			s.audit(opPatch, storage.StorageResourceState, mac, int64(len(patch)), nil)
+			return nil
+		case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+			s.patchUnsupported.Store(true)
+		default:
+			err := s.statusError(r)
+			s.audit(opPatch, storage.StorageResourceState, mac, int64(len(patch)), err)
+			return err
+		}
+	}
+
+	rd, err := full()
+	if err != nil {
+		return err
+	}
+	_, err = s.Put(ctx, storage.StorageResourceState, mac, rd)
+	return err
+}
+
+// CompareAndSwapState replaces the state mac with rd only if its ETag
+// on the server still is expectedETag, "" meaning the state must not
+// exist yet, and returns the ETag of the new state if the server sent
+// one.  ErrPreconditionFailed means another writer got there first.
+func (s *Store) CompareAndSwapState(ctx context.Context, mac objects.MAC, expectedETag string, rd io.Reader) (string, error) {
+	opts := PutOptions{IfMatch: expectedETag}
+	if expectedETag == "" {
+		opts = PutOptions{IfNoneMatch: "*"}
+	}
+	if _, err := s.PutWithOptions(ctx, storage.StorageResourceState, mac, rd, opts); err != nil {
+		return "", err
+	}
+	return s.etags.get(storage.StorageResourceState, mac), nil
+}
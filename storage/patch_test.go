@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// patchServer answers PATCH with status and logs what it gets.
+type patchServer struct {
+	status int
+
+	mu  sync.Mutex
+	log []string
+}
+
+func (p *patchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, _ := io.ReadAll(r.Body)
+	p.mu.Lock()
+	p.log = append(p.log, r.Method+" "+string(data))
+	p.mu.Unlock()
+	if r.Method == "PATCH" {
+		w.WriteHeader(p.status)
+	}
+}
+
+func (p *patchServer) requests() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.log)
+}
+
+func fullState() (io.Reader, error) {
+	return bytes.NewReader([]byte("full state")), nil
+}
+
+func TestPatchState(t *testing.T) {
+	srv := &patchServer{status: http.StatusNoContent}
+	s, _ := newTestStore(t, srv, nil)
+
+	for range 2 {
+		if err := s.PatchState(context.Background(), objects.MAC{1}, []byte("diff"), fullState); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := srv.requests(); !slices.Equal(got, []string{"PATCH diff", "PATCH diff"}) {
+		t.Errorf("server got %q, want two patches", got)
+	}
+}
+
+func TestPatchStateFallback(t *testing.T) {
+	for _, status := range []int{http.StatusMethodNotAllowed, http.StatusNotImplemented} {
+		srv := &patchServer{status: status}
+		s, _ := newTestStore(t, srv, nil)
+
+		for range 2 {
+			if err := s.PatchState(context.Background(), objects.MAC{1}, []byte("diff"), fullState); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := []string{"PATCH diff", "PUT full state", "PUT full state"}
+		if got := srv.requests(); !slices.Equal(got, want) {
+			t.Errorf("%d: server got %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestPatchStateError(t *testing.T) {
+	srv := &patchServer{status: http.StatusConflict}
+	s, _ := newTestStore(t, srv, nil)
+
+	err := s.PatchState(context.Background(), objects.MAC{1}, []byte("diff"), func() (io.Reader, error) {
+		t.Error("a failed patch fell back to a full upload")
+		return fullState()
+	})
+	if err == nil {
+		t.Error("a refused patch succeeded")
+	}
+}
+
+// casServer keeps one state, versioned by its ETag, and honors the
+// conditions uploads come with.
+type casServer struct {
+	mu      sync.Mutex
+	data    []byte
+	version int
+}
+
+func (c *casServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, _ := io.ReadAll(r.Body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	etag := strconv.Quote(strconv.Itoa(c.version))
+	if r.Method != http.MethodPut {
+		if c.version == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(c.data)
+		return
+	}
+	if m := r.Header.Get("If-Match"); m != "" && (c.version == 0 || (m != "*" && m != etag)) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if r.Header.Get("If-None-Match") == "*" && c.version != 0 {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	c.version++
+	c.data = data
+	w.Header().Set("ETag", strconv.Quote(strconv.Itoa(c.version)))
+}
+
+func TestCompareAndSwapState(t *testing.T) {
+	ctx := context.Background()
+	srv := &casServer{}
+	s, _ := newTestStore(t, srv, nil)
+	swap := func(expected, data string) (string, error) {
+		return s.CompareAndSwapState(ctx, objects.MAC{1}, expected, strings.NewReader(data))
+	}
+
+	etag, err := swap("", "first")
+	if err != nil || etag != `"1"` {
+		t.Fatalf("creating the state: %q, %v", etag, err)
+	}
+	if _, err := swap("", "again"); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("creating an existing state: got %v, want ErrPreconditionFailed", err)
+	}
+	if etag, err = swap(etag, "second"); err != nil || etag != `"2"` {
+		t.Fatalf("swapping from the current ETag: %q, %v", etag, err)
+	}
+	if _, err := swap(`"1"`, "stale"); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("swapping from a stale ETag: got %v, want ErrPreconditionFailed", err)
+	}
+	if string(srv.data) != "second" {
+		t.Errorf("server holds %q, want the last successful swap", srv.data)
+	}
+}
+
+func TestCompareAndSwapStateRace(t *testing.T) {
+	ctx := context.Background()
+	srv := &casServer{}
+	s, _ := newTestStore(t, srv, nil)
+	etag, err := s.CompareAndSwapState(ctx, objects.MAC{1}, "", strings.NewReader("base"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var won, lost atomic.Int32
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.CompareAndSwapState(ctx, objects.MAC{1}, etag, strings.NewReader(strconv.Itoa(i)))
+			switch {
+			case err == nil:
+				won.Add(1)
+			case errors.Is(err, ErrPreconditionFailed):
+				lost.Add(1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if won.Load() != 1 || lost.Load() != 9 {
+		t.Errorf("%d swaps from the same ETag won and %d lost, want 1 and 9", won.Load(), lost.Load())
+	}
+}
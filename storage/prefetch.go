@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// maxPrefetchPackfiles bounds how many packfiles are read ahead at once,
+// each holds up to two windows.
+const maxPrefetchPackfiles = 16
+
+// prefetcher reads ahead of sequential ranged reads of a packfile: as a
+// range is read, the bytes following it are fetched in the background
+// so that the next read is served from memory.
+type prefetcher struct {
+	size uint64
+
+	mu    sync.Mutex
+	files map[objects.MAC][]*window
+	order []objects.MAC
+}
+
+// window is a stretch of a packfile being, or done being, read ahead.
+type window struct {
+	offset uint64
+	done   chan struct{}
+	data   []byte
+	err    error
+	cancel context.CancelFunc
+}
+
+func newPrefetcher(size int64) *prefetcher {
+	if size <= 0 {
+		return nil
+	}
+	return &prefetcher{size: uint64(size), files: make(map[objects.MAC][]*window)}
+}
+
+// lookup serves rg from a window when one holds all of it, waiting for
+// a window still in flight that starts at or before rg.
+func (p *prefetcher) lookup(ctx context.Context, mac objects.MAC, rg *storage.Range) ([]byte, bool) {
+	p.mu.Lock()
+	var w *window
+	for _, cand := range p.files[mac] {
+		if rg.Offset >= cand.offset && rg.Offset < cand.offset+p.size {
+			w = cand
+			break
+		}
+	}
+	p.mu.Unlock()
+	if w == nil {
+		return nil, false
+	}
+
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		return nil, false
+	}
+	end := rg.Offset + uint64(rg.Length)
+	if w.err != nil || end > w.offset+uint64(len(w.data)) {
+		return nil, false
+	}
+	return w.data[rg.Offset-w.offset : end-w.offset], true
+}
+
+// schedule reads ahead from offset, unless a window already does.
+func (p *prefetcher) schedule(s *Store, mac objects.MAC, offset uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	windows, known := p.files[mac]
+	for _, w := range windows {
+		if offset >= w.offset && offset < w.offset+p.size {
+			return
+		}
+	}
+	if !known {
+		if len(p.order) >= maxPrefetchPackfiles {
+			p.dropLocked(p.order[0])
+		}
+		p.order = append(p.order, mac)
+	}
+
+	// the window before the last one is done being read from
+	if len(windows) >= 2 {
+		windows[0].cancel()
+		windows = windows[1:]
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	w := &window{offset: offset, done: make(chan struct{}), cancel: cancel}
+	p.files[mac] = append(windows, w)
+
+	go func() {
+		defer close(w.done)
+		rd, err := s.get(ctx, storage.StorageResourcePackfile, mac, &storage.Range{
+			Offset: offset,
+			Length: uint32(p.size),
+		})
+		if err != nil {
+			w.err = err
+			return
+		}
+		defer rd.Close()
+		w.data, w.err = io.ReadAll(io.LimitReader(rd, int64(p.size)))
+	}()
+}
+
+// forget drops what was read ahead of a packfile that changed.
+func (p *prefetcher) forget(res storage.StorageResource, mac objects.MAC) {
+	if p == nil || res != storage.StorageResourcePackfile {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropLocked(mac)
+}
+
+func (p *prefetcher) dropLocked(mac objects.MAC) {
+	for _, w := range p.files[mac] {
+		w.cancel()
+	}
+	delete(p.files, mac)
+	for i, m := range p.order {
+		if m == mac {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+}
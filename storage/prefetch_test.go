@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func (o *objectServer) requests() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.statuses)
+}
+
+func TestReadAhead(t *testing.T) {
+	data := strings.Repeat("0123456789", 100)
+	for _, test := range []struct {
+		readAhead string
+		requests  int
+	}{
+		{"", 20},
+		{"100", 11},
+		{"1000", 2},
+	} {
+		obj := &objectServer{data: []byte(data), etag: `"v1"`}
+		config := map[string]string{}
+		if test.readAhead != "" {
+			config["read_ahead"] = test.readAhead
+		}
+		s, _ := newTestStore(t, obj, config)
+
+		for offset := uint64(0); offset < 1000; offset += 50 {
+			if got := readRange(t, s, offset, 50); got != data[offset:offset+50] {
+				t.Fatalf("read_ahead %q: got %q at offset %d", test.readAhead, got, offset)
+			}
+		}
+		if n := obj.requests(); n != test.requests {
+			t.Errorf("read_ahead %q: 20 sequential reads made %d requests, want %d", test.readAhead, n, test.requests)
+		}
+	}
+}
+
+func TestReadAheadForget(t *testing.T) {
+	obj := &objectServer{data: []byte(strings.Repeat("a", 200)), etag: `"v1"`}
+	s, _ := newTestStore(t, obj, map[string]string{"read_ahead": "100"})
+
+	readRange(t, s, 0, 50)
+	// the window at 50 is in flight or done, an upload drops it
+	readRange(t, s, 50, 10)
+	obj.set(strings.Repeat("b", 200), `"v2"`)
+	if _, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader([]byte("b"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRange(t, s, 60, 10); got != strings.Repeat("b", 10) {
+		t.Fatalf("read after an upload: got %q, want the new packfile", got)
+	}
+}
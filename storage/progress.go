@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Progress is one update on a long-running operation on the server.
+type Progress struct {
+	Step    string `json:"step"`
+	Done    int64  `json:"done"`
+	Total   int64  `json:"total"`
+	Message string `json:"message"`
+}
+
+// WatchOperation follows the progress of the server-side operation id,
+// calling fn for every update in the order the server sends them.  It
+// returns once the operation completes, with the server's error if it
+// failed.
+func (s *Store) WatchOperation(ctx context.Context, id string, fn func(Progress)) error {
+	r, err := s.sendRequest(ctx, &request{
+		method: "GET",
+		path:   "/operations/" + url.PathEscape(id) + "/progress",
+		header: http.Header{"Accept": {"text/event-stream"}},
+	})
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if isUnsupported(r.StatusCode) {
+		return ErrUnsupported
+	}
+	if r.StatusCode != 200 {
+		return s.statusError(r)
+	}
+	if err := checkContentType(r, "text/event-stream"); err != nil {
+		return err
+	}
+
+	var opErr error
+	completed := false
+	err = readEvents(r.Body, func(ev sseEvent) bool {
+		switch ev.name {
+		case "progress":
+			var p Progress
+			if err := json.Unmarshal([]byte(ev.data), &p); err == nil {
+				fn(p)
+			}
+			return true
+		case "done":
+			completed = true
+			return false
+		case "error":
+			completed = true
+			opErr = fmt.Errorf("operation %s failed: %s", id, ev.data)
+			return false
+		default:
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !completed {
+		return fmt.Errorf("progress stream for operation %s ended early", id)
+	}
+	return opErr
+}
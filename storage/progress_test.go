@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// progressServer streams the given events for operation op-1.
+func progressServer(events ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/operations/op-1/progress" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, ev := range events {
+			fmt.Fprint(w, ev+"\n\n")
+			w.(http.Flusher).Flush()
+		}
+	})
+}
+
+func TestWatchOperation(t *testing.T) {
+	s, _ := newTestStore(t, progressServer(
+		`event: progress`+"\n"+`data: {"step":"scan","done":0,"total":3}`,
+		`event: progress`+"\n"+`data: {"step":"scan","done":1,"total":3}`,
+		`event: heartbeat`+"\n"+`data: {}`,
+		`event: progress`+"\n"+`data: {"step":"compact","done":3,"total":3,"message":"almost"}`,
+		`event: done`+"\n"+`data: {}`,
+		`event: progress`+"\n"+`data: {"step":"after the end"}`,
+	), nil)
+
+	var got []Progress
+	if err := s.WatchOperation(context.Background(), "op-1", func(p Progress) { got = append(got, p) }); err != nil {
+		t.Fatal(err)
+	}
+	want := []Progress{
+		{Step: "scan", Done: 0, Total: 3},
+		{Step: "scan", Done: 1, Total: 3},
+		{Step: "compact", Done: 3, Total: 3, Message: "almost"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got updates %v, want %v", got, want)
+	}
+}
+
+func TestWatchOperationFailure(t *testing.T) {
+	for _, test := range []struct {
+		events []string
+		err    string
+	}{
+		{[]string{"event: error\ndata: disk full"}, "operation op-1 failed: disk full"},
+		{[]string{`event: progress` + "\n" + `data: {"step":"scan"}`}, "ended early"},
+	} {
+		s, _ := newTestStore(t, progressServer(test.events...), nil)
+		err := s.WatchOperation(context.Background(), "op-1", func(Progress) {})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("got %v, want %q", err, test.err)
+		}
+	}
+}
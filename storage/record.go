@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// WrapTransport replaces the store's transport with what fn returns
+// when handed the current one.  It must be called before the store is
+// used.
+func (s *Store) WrapTransport(fn func(http.RoundTripper) http.RoundTripper) {
+	s.client.Transport = fn(s.client.Transport)
+}
+
+// interaction is one request and its response as saved by a Recorder,
+// one JSON object per line.
+type interaction struct {
+	Method      string      `json:"method"`
+	URI         string      `json:"uri"`
+	RequestBody []byte      `json:"request_body,omitempty"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// requestURI leaves the host out so that a recording can be replayed
+// against any location.
+func requestURI(req *http.Request) string {
+	return req.URL.RequestURI()
+}
+
+// Recorder is a RoundTripper saving every exchange it forwards to next,
+// for a Replayer to serve back later.
+type Recorder struct {
+	next http.RoundTripper
+	mu   sync.Mutex
+	fp   *os.File
+	enc  *json.Encoder
+}
+
+// NewRecorder records the exchanges made through next to path, which
+// is truncated.
+func NewRecorder(next http.RoundTripper, path string) (*Recorder, error) {
+	fp, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{next: next, fp: fp, enc: json.NewEncoder(fp)}, nil
+}
+
+func (rec *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	r, err := rec.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	err = rec.enc.Encode(&interaction{
+		Method:      req.Method,
+		URI:         requestURI(req),
+		RequestBody: reqBody,
+		Status:      r.StatusCode,
+		Header:      r.Header,
+		Body:        body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close flushes the recording.
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.fp.Close()
+}
+
+// Replayer is a RoundTripper answering from a recording, without ever
+// reaching a server.  Each request is answered by the first exchange
+// not served yet with the same method and URI, so that a sequence of
+// reads and writes to the same object replays in order.
+type Replayer struct {
+	mu           sync.Mutex
+	interactions []*interaction
+	used         []bool
+}
+
+// NewReplayer loads a recording made by a Recorder.
+func NewReplayer(path string) (*Replayer, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	rep := &Replayer{}
+	dec := json.NewDecoder(bufio.NewReader(fp))
+	for {
+		var it interaction
+		if err := dec.Decode(&it); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		rep.interactions = append(rep.interactions, &it)
+	}
+	rep.used = make([]bool, len(rep.interactions))
+	return rep, nil
+}
+
+func (rep *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	uri := requestURI(req)
+
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	for i, it := range rep.interactions {
+		if rep.used[i] || it.Method != req.Method || it.URI != uri {
+			continue
+		}
+		rep.used[i] = true
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", it.Status, http.StatusText(it.Status)),
+			StatusCode:    it.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        it.Header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(it.Body)),
+			ContentLength: int64(len(it.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded response for %s %s", req.Method, uri)
+}
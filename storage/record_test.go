@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// session runs an Open/Put/Get/Delete cycle and returns what was read
+// back.
+func session(t *testing.T, s *Store) (config, data []byte) {
+	t.Helper()
+	ctx := context.Background()
+
+	config, err := s.Open(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(ctx, storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader([]byte("packfile"))); err != nil {
+		t.Fatal(err)
+	}
+	rd, err := s.Get(ctx, storage.StorageResourcePackfile, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = io.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, storage.StorageResourcePackfile, objects.MAC{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, storage.StorageResourcePackfile, objects.MAC{1}, nil); err == nil {
+		t.Fatal("Get after Delete succeeded")
+	}
+	return config, data
+}
+
+func TestRecordReplay(t *testing.T) {
+	recording := filepath.Join(t.TempDir(), "session.jsonl")
+
+	s, _ := newTestStore(t, &memServer{config: []byte("repository config")}, map[string]string{"max_retries": "0"})
+	var rec *Recorder
+	s.WrapTransport(func(next http.RoundTripper) http.RoundTripper {
+		var err error
+		if rec, err = NewRecorder(next, recording); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	})
+	config, data := session(t, s)
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing listens there, only the recording can answer
+	replay, err := newStore(map[string]string{"location": "http://" + closedPort(t) + "/", "max_retries": "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { replay.Close(context.Background()) })
+	rep, err := NewReplayer(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay.WrapTransport(func(http.RoundTripper) http.RoundTripper { return rep })
+
+	config2, data2 := session(t, replay)
+	if !bytes.Equal(config, config2) || !bytes.Equal(data, data2) {
+		t.Errorf("replay read %q and %q, the recording %q and %q", config2, data2, config, data)
+	}
+
+	// everything was served once already
+	if _, err := replay.Open(context.Background()); err == nil {
+		t.Error("replayed past the end of the recording")
+	}
+}
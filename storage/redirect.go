@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const maxRedirects = 10
+
+type objectFetchKey struct{}
+
+// withObjectFetch marks requests fetching object data, the server may
+// send those off to a CDN.
+func withObjectFetch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, objectFetchKey{}, true)
+}
+
+func isObjectFetch(ctx context.Context) bool {
+	v, _ := ctx.Value(objectFetchKey{}).(bool)
+	return v
+}
+
+func (s *Store) checkRedirect(req *http.Request, via []*http.Request) error {
+	// a URL seen before on the way means going round in circles,
+	// say between /path and /path/ behind a rewriting proxy.
+	for i, prev := range via {
+		if prev.URL.String() != req.URL.String() {
+			continue
+		}
+		cycle := make([]string, 0, len(via)-i+1)
+		for _, hop := range via[i:] {
+			cycle = append(cycle, hop.URL.String())
+		}
+		cycle = append(cycle, req.URL.String())
+		return fmt.Errorf("redirect loop detected: %s", strings.Join(cycle, " -> "))
+	}
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	if !s.redirectAllowed(req, via) {
+		return fmt.Errorf("redirect to %s refused: not in redirect_allowed_hosts", req.URL.Host)
+	}
+
+	s.noteRedirect(req, via)
+
+	if !isObjectFetch(req.Context()) {
+		return nil
+	}
+
+	// the CDN gets the same byte range but none of the credentials
+	// meant for the storage server.
+	orig := via[0]
+	if rg := orig.Header.Get("Range"); rg != "" {
+		req.Header.Set("Range", rg)
+	}
+	if req.URL.Host != orig.URL.Host && !s.isUpgradeRedirect(req, via) {
+		req.Header.Del("Authorization")
+		req.Header.Del(nonceHeader)
+		if s.cdnAuthToken != "" {
+			req.Header.Set("Authorization", "Bearer "+s.cdnAuthToken)
+		}
+	}
+	return nil
+}
+
+func parseAllowedHosts(storeConfig map[string]string) []string {
+	value, ok := storeConfig["redirect_allowed_hosts"]
+	if !ok {
+		return nil
+	}
+	ret := []string{}
+	for _, host := range strings.Split(value, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			ret = append(ret, host)
+		}
+	}
+	return ret
+}
+
+// redirectAllowed tells whether a redirect may be followed: anywhere
+// when no allowlist is configured, otherwise only to the host the
+// request started on or to a listed one.  Entries are a host, with or
+// without a port, or *.domain for any host under domain.
+func (s *Store) redirectAllowed(req *http.Request, via []*http.Request) bool {
+	if s.redirectHosts == nil {
+		return true
+	}
+
+	host := strings.ToLower(req.URL.Host)
+	name := strings.ToLower(req.URL.Hostname())
+	if host == strings.ToLower(via[0].URL.Host) {
+		return true
+	}
+	for _, allowed := range s.redirectHosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(name, "."+suffix) {
+				return true
+			}
+		} else if allowed == host || allowed == name {
+			return true
+		}
+	}
+	return false
+}
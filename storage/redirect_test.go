@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestRedirectToCDN(t *testing.T) {
+	for _, token := range []string{"", "cdn-secret"} {
+		t.Run("cdn_auth_token="+token, func(t *testing.T) {
+			var mu sync.Mutex
+			var auth []string
+			obj := &objectServer{data: []byte("0123456789"), etag: `"v1"`}
+			cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				auth = append(auth, r.Header.Get("Authorization"))
+				mu.Unlock()
+				obj.ServeHTTP(w, r)
+			}))
+			t.Cleanup(cdn.Close)
+
+			config := map[string]string{"auth_token": "storage-secret"}
+			if token != "" {
+				config["cdn_auth_token"] = token
+			}
+			s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer storage-secret" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				http.Redirect(w, r, cdn.URL+r.URL.Path, http.StatusFound)
+			}), config)
+
+			rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, &storage.Range{Offset: 2, Length: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(rd)
+			rd.Close()
+			if err != nil || string(data) != "234" {
+				t.Errorf("read %q, %v from the CDN, want %q", data, err, "234")
+			}
+			if status := obj.lastStatus(); status != http.StatusPartialContent {
+				t.Errorf("the CDN answered %d, want the Range forwarded", status)
+			}
+
+			want := ""
+			if token != "" {
+				want = "Bearer " + token
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(auth) != 1 || auth[0] != want {
+				t.Errorf("the CDN got Authorization %q, want %q", auth, want)
+			}
+		})
+	}
+}
+
+func TestRedirectAllowedHosts(t *testing.T) {
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from the cdn"))
+	}))
+	t.Cleanup(cdn.Close)
+	cdnURL, _ := url.Parse(cdn.URL)
+
+	for _, test := range []struct {
+		allowed string
+		ok      bool
+	}{
+		{"-", true},
+		{cdnURL.Host, true},
+		{"example.com, " + cdnURL.Hostname(), true},
+		{"localhost", false},
+		{"127.0.0.1:1", false},
+		{"", false},
+	} {
+		config := map[string]string{"max_retries": "0"}
+		if test.allowed != "-" {
+			config["redirect_allowed_hosts"] = test.allowed
+		}
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, cdn.URL+r.URL.Path, http.StatusFound)
+		}), config)
+
+		err := getState(s)
+		if test.ok && err != nil {
+			t.Errorf("redirect_allowed_hosts %q: %v", test.allowed, err)
+		} else if !test.ok && (err == nil || !strings.Contains(err.Error(), "not in redirect_allowed_hosts")) {
+			t.Errorf("redirect_allowed_hosts %q: got %v, want the redirect refused", test.allowed, err)
+		}
+	}
+}
+
+func TestRedirectAllowedSameHost(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/moved" {
+			http.Redirect(w, r, "/moved", http.StatusFound)
+		}
+	}), map[string]string{"redirect_allowed_hosts": "example.com"})
+	if err := getState(s); err != nil {
+		t.Fatalf("redirect to the same host: %v", err)
+	}
+}
+
+func TestRedirectAllowedWildcard(t *testing.T) {
+	s := &Store{redirectHosts: parseAllowedHosts(map[string]string{"redirect_allowed_hosts": "*.cdn.example, Mirror.example:8443"})}
+	orig := httptest.NewRequest("GET", "https://storage.example/resources/states/01", nil)
+	for _, test := range []struct {
+		target string
+		ok     bool
+	}{
+		{"https://eu.cdn.example/x", true},
+		{"https://a.b.cdn.example:8080/x", true},
+		{"https://cdn.example/x", false},
+		{"https://evilcdn.example/x", false},
+		{"https://mirror.example:8443/x", true},
+		{"https://mirror.example/x", false},
+		{"https://STORAGE.example/x", true},
+	} {
+		req := httptest.NewRequest("GET", test.target, nil)
+		if ok := s.redirectAllowed(req, []*http.Request{orig}); ok != test.ok {
+			t.Errorf("redirect to %s: allowed %v, want %v", test.target, ok, test.ok)
+		}
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	var hits atomic.Int32
+	s, srv := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if p, ok := strings.CutSuffix(r.URL.Path, "/"); ok {
+			http.Redirect(w, r, p, http.StatusMovedPermanently)
+		} else {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		}
+	}), map[string]string{"max_retries": "0"})
+
+	err := getState(s)
+	path := srv.URL + "/resources/states/" + fmt.Sprintf("%016x", objects.MAC{1})
+	want := "redirect loop detected: " + path + " -> " + path + "/ -> " + path
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("got %v, want %q", err, want)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("%d requests, want the loop caught on coming back", n)
+	}
+}
+
+func TestRedirectChain(t *testing.T) {
+	for _, test := range []struct {
+		hops int
+		ok   bool
+	}{
+		{1, true},
+		{maxRedirects - 1, true},
+		{maxRedirects + 5, false},
+	} {
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, _ := strconv.Atoi(r.URL.Query().Get("hop"))
+			if n < test.hops {
+				http.Redirect(w, r, fmt.Sprintf("%s?hop=%d", r.URL.Path, n+1), http.StatusFound)
+			}
+		}), map[string]string{"max_retries": "0"})
+
+		err := getState(s)
+		if test.ok && err != nil {
+			t.Errorf("%d redirects: %v", test.hops, err)
+		} else if !test.ok && (err == nil || !strings.Contains(err.Error(), "stopped after")) {
+			t.Errorf("%d redirects: got %v, want the chain cut", test.hops, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultRetrievalPoll is how often an object being brought back from
+// cold storage is asked for when the server doesn't say.
+const defaultRetrievalPoll = 10 * time.Second
+
+// defaultRetrievalMaxWait is how long an object is waited for before
+// giving up, retrievals from archive tiers take hours.
+const defaultRetrievalMaxWait = 24 * time.Hour
+
+// sendRetrieving sends rq and, for as long as the server answers 202
+// because the object is being retrieved from cold storage, asks again
+// when it says to.  ctx and retrieval_max_wait bound the wait.
+func (s *Store) sendRetrieving(ctx context.Context, rq *request) (*http.Response, error) {
+	start := s.clock.Now()
+	for {
+		r, err := s.sendRequest(ctx, rq)
+		if err != nil || r.StatusCode != http.StatusAccepted {
+			return r, err
+		}
+		discard(r)
+
+		wait := s.retrievalPoll
+		if secs, err := strconv.Atoi(r.Header.Get("Retry-After")); err == nil && secs > 0 {
+			wait = time.Duration(secs) * time.Second
+		}
+		// the last ask is at the limit, whatever the server says
+		if s.retrievalMaxWait > 0 {
+			left := s.retrievalMaxWait - s.clock.Now().Sub(start)
+			if left <= 0 {
+				return nil, fmt.Errorf("%s still being retrieved after %s", rq.path, s.retrievalMaxWait)
+			}
+			wait = min(wait, left)
+		}
+		s.logger.Debug("object retrieval in progress", "path", rq.path, "wait", wait)
+		if err := sleepContext(ctx, s.clock, wait); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// coldServer answers 202 with retryAfter to the first pending requests,
+// then serves the object.
+func coldServer(retryAfter string, pending int32, hits *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= pending {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Write([]byte("thawed packfile"))
+	}
+}
+
+func TestColdRetrieval(t *testing.T) {
+	for _, test := range []struct {
+		retryAfter string
+		wait       time.Duration
+	}{
+		{"30", 30 * time.Second},
+		{"", 5 * time.Second},
+	} {
+		var hits atomic.Int32
+		clk := newFakeClock()
+		s, _ := newTestStoreClock(t, coldServer(test.retryAfter, 2, &hits), map[string]string{"retrieval_poll_interval": "5s"}, clk)
+
+		type result struct {
+			data []byte
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, nil)
+			if err != nil {
+				done <- result{err: err}
+				return
+			}
+			defer rd.Close()
+			data, err := io.ReadAll(rd)
+			done <- result{data, err}
+		}()
+
+		for range 2 {
+			if d := clk.nextWait(t); d != test.wait {
+				t.Errorf("Retry-After %q: waited %s, want %s", test.retryAfter, d, test.wait)
+			}
+			clk.Advance(test.wait)
+		}
+		res := <-done
+		if res.err != nil || string(res.data) != "thawed packfile" {
+			t.Fatalf("Retry-After %q: got %q, %v", test.retryAfter, res.data, res.err)
+		}
+		if n := hits.Load(); n != 3 {
+			t.Errorf("Retry-After %q: %d requests, want 3", test.retryAfter, n)
+		}
+	}
+}
+
+func TestColdRetrievalCanceled(t *testing.T) {
+	var hits atomic.Int32
+	clk := newFakeClock()
+	s, _ := newTestStoreClock(t, coldServer("3600", 1000, &hits), nil, clk)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Get(ctx, storage.StorageResourcePackfile, objects.MAC{1}, nil)
+		done <- err
+	}()
+	clk.nextWait(t)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want the wait for the retrieval canceled", err)
+	}
+}
+
+func TestColdRetrievalMaxWait(t *testing.T) {
+	var hits atomic.Int32
+	clk := newFakeClock()
+	s, _ := newTestStoreClock(t, coldServer("40", 1000, &hits), map[string]string{"retrieval_max_wait": "1m"}, clk)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, nil)
+		done <- err
+	}()
+	// the second wait is cut to what's left of the minute
+	for _, want := range []time.Duration{40 * time.Second, 20 * time.Second} {
+		if d := clk.nextWait(t); d != want {
+			t.Errorf("waited %s, want %s", d, want)
+		}
+		clk.Advance(want)
+	}
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "still being retrieved after 1m0s") {
+		t.Fatalf("got %v, want the retrieval given up on", err)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("%d requests, want 3", n)
+	}
+}
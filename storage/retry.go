@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultRetryDelay = 100 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+)
+
+type retryPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+
+	// retries are logged at that level when set
+	logLevel *slog.Level
+
+	// statuses retried, or not, regardless of the defaults
+	statuses map[int]bool
+}
+
+func parseRetryPolicy(storeConfig map[string]string) (retryPolicy, error) {
+	p := retryPolicy{
+		maxRetries: defaultMaxRetries,
+		baseDelay:  defaultRetryDelay,
+		maxDelay:   defaultMaxBackoff,
+	}
+	var err error
+
+	if _, ok := storeConfig["max_retries"]; ok {
+		if p.maxRetries, err = parseCount(storeConfig, "max_retries"); err != nil {
+			return p, err
+		}
+	}
+	if _, ok := storeConfig["retry_delay"]; ok {
+		if p.baseDelay, err = parseDuration(storeConfig, "retry_delay"); err != nil {
+			return p, err
+		}
+	}
+	if _, ok := storeConfig["max_backoff"]; ok {
+		if p.maxDelay, err = parseDuration(storeConfig, "max_backoff"); err != nil {
+			return p, err
+		}
+	}
+	if value, ok := storeConfig["retry_log_level"]; ok && value != "off" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return p, fmt.Errorf("invalid retry_log_level %q: expected off, debug, info, warn or error", value)
+		}
+		p.logLevel = &level
+	}
+	for key, retry := range map[string]bool{"retry_on": true, "no_retry_on": false} {
+		value, ok := storeConfig[key]
+		if !ok {
+			continue
+		}
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			code, err := strconv.Atoi(field)
+			if err != nil || code < 100 || code > 599 {
+				return p, fmt.Errorf("invalid %s entry %q: expected an HTTP status code", key, field)
+			}
+			if prev, ok := p.statuses[code]; ok && prev != retry {
+				return p, fmt.Errorf("status %d is in both retry_on and no_retry_on", code)
+			}
+			if p.statuses == nil {
+				p.statuses = make(map[int]bool)
+			}
+			p.statuses[code] = retry
+		}
+	}
+	return p, nil
+}
+
+// backoff is the delay before retry number attempt+1: it doubles every
+// time up to the cap, and is jittered within its upper half so that
+// clients failing together don't come back together.
+func (p *retryPolicy) backoff(attempt int, j *jitter) time.Duration {
+	d := p.maxDelay
+	if attempt < 32 {
+		if exp := p.baseDelay << attempt; exp > 0 && exp < d {
+			d = exp
+		}
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + j.n(d-half+1)
+}
+
+// jitter draws the random part of the backoffs, and the injected
+// faults.  It uses the global, randomly seeded, source unless the store
+// was handed one, which makes the draws reproducible in tests.
+type jitter struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (j *jitter) n(d time.Duration) time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.r == nil {
+		return rand.N(d)
+	}
+	return time.Duration(j.r.Int64N(int64(d)))
+}
+
+// float draws from [0, 1).
+func (j *jitter) float() float64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.r == nil {
+		return rand.Float64()
+	}
+	return j.r.Float64()
+}
+
+// SetBackoffRand makes the store draw the jitter of its retry delays,
+// and its injected faults, from r, nil going back to the global source.
+func (s *Store) SetBackoffRand(r *rand.Rand) {
+	s.jitter.mu.Lock()
+	defer s.jitter.mu.Unlock()
+	s.jitter.r = r
+}
+
+// retryable tells whether a failed attempt is worth sending again.
+func (p *retryPolicy) retryable(ctx context.Context, r *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	if retry, ok := p.statuses[r.StatusCode]; ok {
+		return retry
+	}
+	switch r.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryReason describes why an attempt failed, in words an operator can
+// act on.
+func retryReason(r *http.Response, err error) string {
+	if err == nil {
+		return fmt.Sprintf("HTTP %d", r.StatusCode)
+	}
+	var nerr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.As(err, &nerr) && nerr.Timeout():
+		return "timeout"
+	default:
+		return err.Error()
+	}
+}
+
+func (s *Store) logRetry(ctx context.Context, p *retryPolicy, rq *request, attempt int, reason string, delay time.Duration) {
+	if p.logLevel == nil {
+		return
+	}
+	s.logger.Log(ctx, *p.logLevel, "retrying request",
+		"method", rq.method,
+		"path", rq.path,
+		"attempt", attempt,
+		"reason", reason,
+		"delay", delay)
+}
+
+// discard throws away a response that is not going to be looked at,
+// reading a bit of it so the connection can be reused.
+func discard(r *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(r.Body, 4096))
+	r.Body.Close()
+}
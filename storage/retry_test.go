@@ -0,0 +1,341 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// failingHandler answers status to the first failures requests, then
+// 200.
+func failingHandler(status int, failures int32, hits *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if hits.Add(1) <= failures {
+			w.WriteHeader(status)
+		}
+	}
+}
+
+func TestBackoffFakeClock(t *testing.T) {
+	var hits atomic.Int32
+	clk := newFakeClock()
+	s, _ := newTestStoreClock(t, failingHandler(http.StatusServiceUnavailable, 3, &hits),
+		map[string]string{"retry_delay": "1s", "max_backoff": "1m"}, clk)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("state")))
+		done <- err
+	}()
+
+	for attempt := range 3 {
+		d := clk.nextWait(t)
+		full := time.Second << attempt
+		if d < full/2 || d > full {
+			t.Errorf("retry %d waited %s, want between %s and %s", attempt+1, d, full/2, full)
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("upload done before the clock moved: %v", err)
+		default:
+		}
+		clk.Advance(d)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := hits.Load(); n != 4 {
+		t.Errorf("server hit %d times, want 4", n)
+	}
+}
+
+func TestClockReachesEveryUser(t *testing.T) {
+	t.Setenv("PLAKAR_HTTP_FAULT_INJECTION", "1")
+	clk := newFakeClock()
+	s, _ := newTestStoreClock(t, http.NotFoundHandler(), map[string]string{
+		"max_upload_bandwidth":       "1000",
+		"max_download_bandwidth":     "1000",
+		"debug_fault_injection_rate": "0.5",
+	}, clk)
+
+	if s.clock != clk || s.uploadLimiter.clock != clk || s.downloadLimiter.clock != clk {
+		t.Error("bandwidth limiters don't use the store clock")
+	}
+	injector, _ := s.client.Transport.(*faultInjector)
+	if injector == nil || injector.clock != clk {
+		t.Error("fault injector doesn't use the store clock")
+	}
+}
+
+type okTransport struct{}
+
+func (okTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func TestFaultInjectionRate(t *testing.T) {
+	const n, rate = 2000, 0.3
+	f := &faultInjector{
+		next:  okTransport{},
+		clock: newFakeClock(),
+		rand:  &jitter{r: rand.New(rand.NewPCG(1, 2))},
+		rate:  rate,
+	}
+
+	failed := 0
+	for range n {
+		req, _ := http.NewRequest("GET", "http://localhost/", nil)
+		if _, err := f.RoundTrip(req); err == errInjectedFault {
+			failed++
+		}
+	}
+	if got := float64(failed) / n; got < rate-0.05 || got > rate+0.05 {
+		t.Errorf("%d of %d requests failed, want about %v", failed, n, rate)
+	}
+}
+
+func TestFaultInjectionDelayAlone(t *testing.T) {
+	t.Setenv("PLAKAR_HTTP_FAULT_INJECTION", "1")
+	_, _, err := parseFaultInjection(map[string]string{"debug_fault_injection_delay": "1s"})
+	if err == nil || !strings.Contains(err.Error(), "requires debug_fault_injection_rate") {
+		t.Errorf("got %v, want the missing rate named", err)
+	}
+}
+
+func TestMaxBackoff(t *testing.T) {
+	p, err := parseRetryPolicy(map[string]string{"retry_delay": "1s", "max_backoff": "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j jitter
+	capped := map[time.Duration]bool{}
+	for attempt := range 200 {
+		d := p.backoff(attempt, &j)
+		if d > 5*time.Second {
+			t.Fatalf("retry %d waits %s, past the 5s cap", attempt+1, d)
+		}
+		if attempt >= 3 {
+			if d < 2500*time.Millisecond {
+				t.Fatalf("retry %d waits %s, want the jitter within the upper half of the cap", attempt+1, d)
+			}
+			capped[d] = true
+		}
+	}
+	if len(capped) < 2 {
+		t.Error("capped delays are not jittered")
+	}
+}
+
+func TestMaxBackoffRetries(t *testing.T) {
+	var hits atomic.Int32
+	clk := newFakeClock()
+	s, _ := newTestStoreClock(t, failingHandler(http.StatusServiceUnavailable, 20, &hits),
+		map[string]string{"retry_delay": "1s", "max_backoff": "3s", "max_retries": "20"}, clk)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("state")))
+		done <- err
+	}()
+	for attempt := range 20 {
+		d := clk.nextWait(t)
+		if d > 3*time.Second {
+			t.Errorf("retry %d waited %s, past max_backoff", attempt+1, d)
+		}
+		clk.Advance(d)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// logRecorder keeps the records logged through it.
+type logRecorder struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (l *logRecorder) Enabled(context.Context, slog.Level) bool { return true }
+func (l *logRecorder) WithAttrs([]slog.Attr) slog.Handler       { return l }
+func (l *logRecorder) WithGroup(string) slog.Handler            { return l }
+
+func (l *logRecorder) Handle(_ context.Context, r slog.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, r.Clone())
+	return nil
+}
+
+func TestRetryLog(t *testing.T) {
+	var hits atomic.Int32
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch hits.Add(1) {
+		case 1:
+			// a fresh connection next, the transport would replay a
+			// reset one on its own
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		case 3:
+			time.Sleep(200 * time.Millisecond)
+		}
+	}), map[string]string{"retry_log_level": "warn", "read_timeout": "50ms", "max_retries": "5"})
+	logs := &logRecorder{}
+	s.logger = slog.New(logs)
+
+	rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	want := []string{"HTTP 503", "connection reset", "timeout"}
+	if len(logs.records) != len(want) {
+		t.Fatalf("logged %d retries, want %d", len(logs.records), len(want))
+	}
+	for i, rec := range logs.records {
+		attrs := map[string]slog.Value{}
+		rec.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		if rec.Level != slog.LevelWarn || attrs["reason"].String() != want[i] ||
+			attrs["attempt"].Int64() != int64(i+1) || attrs["delay"].Duration() <= 0 {
+			t.Errorf("retry %d logged %v %q %v, want %q", i+1, rec.Level, rec.Message, attrs, want[i])
+		}
+	}
+}
+
+func TestRetryLogOff(t *testing.T) {
+	var hits atomic.Int32
+	s, _ := newTestStore(t, failingHandler(http.StatusServiceUnavailable, 2, &hits), nil)
+	logs := &logRecorder{}
+	s.logger = slog.New(logs)
+
+	if _, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("state"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs.records) != 0 {
+		t.Errorf("logged %d records with retry_log_level unset", len(logs.records))
+	}
+}
+
+func TestRetryOn(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		config map[string]string
+		hits   int32
+	}{
+		{http.StatusRequestTimeout, nil, 1},
+		{http.StatusRequestTimeout, map[string]string{"retry_on": "408, 425"}, 3},
+		{http.StatusTooEarly, map[string]string{"retry_on": "408, 425"}, 3},
+		{http.StatusServiceUnavailable, nil, 3},
+		{http.StatusServiceUnavailable, map[string]string{"no_retry_on": "503"}, 1},
+		{http.StatusBadGateway, map[string]string{"no_retry_on": "503"}, 3},
+	} {
+		var hits atomic.Int32
+		config := map[string]string{"max_retries": "2"}
+		for k, v := range test.config {
+			config[k] = v
+		}
+		s, _ := newTestStore(t, failingHandler(test.status, 2, &hits), config)
+		s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("state")))
+		if n := hits.Load(); n != test.hits {
+			t.Errorf("status %d with %v: %d requests, want %d", test.status, test.config, n, test.hits)
+		}
+	}
+}
+
+func TestRetryOnConfig(t *testing.T) {
+	for _, config := range []map[string]string{
+		{"retry_on": "408,abc"},
+		{"retry_on": "99"},
+		{"no_retry_on": "600"},
+		{"retry_on": "503", "no_retry_on": "503"},
+	} {
+		config["location"] = "http://localhost"
+		if _, err := newStore(config); err == nil {
+			t.Errorf("%v accepted", config)
+		}
+	}
+}
+
+// backoffWaits has a store seeded with seed retry 5 failures and
+// returns the waits in between.
+func backoffWaits(t *testing.T, seed uint64) []time.Duration {
+	var hits atomic.Int32
+	clk := newFakeClock()
+	s, _ := newTestStoreClock(t, failingHandler(http.StatusServiceUnavailable, 5, &hits),
+		map[string]string{"retry_delay": "1s", "max_backoff": "1m", "max_retries": "5"}, clk)
+	s.SetBackoffRand(rand.New(rand.NewPCG(seed, seed)))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("state")))
+		done <- err
+	}()
+	var waits []time.Duration
+	for range 5 {
+		d := clk.nextWait(t)
+		waits = append(waits, d)
+		clk.Advance(d)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return waits
+}
+
+func TestBackoffSeeded(t *testing.T) {
+	// the same draws, made by hand
+	r := rand.New(rand.NewPCG(42, 42))
+	var want []time.Duration
+	for attempt := range 5 {
+		d := time.Second << attempt
+		want = append(want, d/2+time.Duration(r.Int64N(int64(d-d/2+1))))
+	}
+
+	for range 2 {
+		if got := backoffWaits(t, 42); !slices.Equal(got, want) {
+			t.Fatalf("seeded backoffs %v, want %v", got, want)
+		}
+	}
+	if got := backoffWaits(t, 7); slices.Equal(got, want) {
+		t.Errorf("backoffs %v drawn from another seed are the same", got)
+	}
+}
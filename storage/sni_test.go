@@ -0,0 +1,106 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newSNIServer starts a TLS server, its certificate is valid for
+// example.com and 127.0.0.1, that records the names clients present.
+func newSNIServer(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var names []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		mu.Lock()
+		names = append(names, hello.ServerName)
+		mu.Unlock()
+		return nil, nil
+	}}
+	// the refused handshakes are expected
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return names
+	}
+}
+
+func newSNIStore(t *testing.T, srv *httptest.Server, config map[string]string) *Store {
+	t.Helper()
+	cfg := map[string]string{"location": srv.URL, "max_retries": "0"}
+	for k, v := range config {
+		cfg[k] = v
+	}
+	s, err := newStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close(context.Background()) })
+	if s.transport.TLSClientConfig == nil {
+		s.transport.TLSClientConfig = &tls.Config{}
+	}
+	s.transport.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	return s
+}
+
+func TestTLSServerName(t *testing.T) {
+	srv, names := newSNIServer(t)
+
+	// dialed by address, checked against the name
+	s := newSNIStore(t, srv, map[string]string{"tls_server_name": "example.com"})
+	if err := getState(s); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); len(got) != 1 || got[0] != "example.com" {
+		t.Fatalf("server saw SNI %v, want example.com", got)
+	}
+
+	s = newSNIStore(t, srv, map[string]string{"tls_server_name": "storage.example"})
+	if err := getState(s); err == nil || !strings.Contains(err.Error(), "storage.example") {
+		t.Fatalf("certificate not valid for tls_server_name: got %v, want it refused", err)
+	}
+}
+
+func TestTLSServerNameTunnel(t *testing.T) {
+	srv, names := newSNIServer(t)
+	proxy := &connectProxy{}
+	proxySrv := httptest.NewServer(proxy)
+	t.Cleanup(proxySrv.Close)
+
+	s := newSNIStore(t, srv, map[string]string{"tls_server_name": "example.com", "proxy_tunnel": proxySrv.URL})
+	if err := getState(s); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); len(got) != 1 || got[0] != "example.com" {
+		t.Errorf("server saw SNI %v through the tunnel, want example.com", got)
+	}
+	if targets, _ := proxy.seen(); len(targets) != 1 || targets[0] != strings.TrimPrefix(srv.URL, "https://") {
+		t.Errorf("proxy got CONNECT to %v, want the dialed address", targets)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// stateCache keeps the states the server allowed to be cached, for as
+// long as it said they are fresh.
+type stateCache struct {
+	mu sync.Mutex
+	m  map[objects.MAC]*cachedState
+}
+
+type cachedState struct {
+	data    []byte
+	etag    string
+	expires time.Time
+}
+
+func (c *stateCache) get(mac objects.MAC) *cachedState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.m[mac]
+}
+
+func (c *stateCache) set(mac objects.MAC, st *cachedState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if st == nil {
+		delete(c.m, mac)
+		return
+	}
+	if c.m == nil {
+		c.m = make(map[objects.MAC]*cachedState)
+	}
+	c.m[mac] = st
+}
+
+func (c *stateCache) forget(res storage.StorageResource, mac objects.MAC) {
+	if c != nil && res == storage.StorageResourceState {
+		c.set(mac, nil)
+	}
+}
+
+// freshness reads how long r may be served from the cache: ok is false
+// when it must not be stored at all.  A response that must be
+// revalidated every time is stored as already expired.
+func freshness(r *http.Response, now time.Time) (expires time.Time, ok bool) {
+	var maxAge = -1
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			return time.Time{}, false
+		case "no-cache":
+			return now, true
+		case "max-age":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+				maxAge = n
+			}
+		}
+	}
+
+	if maxAge >= 0 {
+		age, _ := strconv.Atoi(r.Header.Get("Age"))
+		return now.Add(time.Duration(maxAge-age) * time.Second), true
+	}
+	if t, err := http.ParseTime(r.Header.Get("Expires")); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// getCachedState serves a state from the cache while it is fresh, and
+// revalidates it with its ETag once it expired.
+func (s *Store) getCachedState(ctx context.Context, mac objects.MAC) (io.ReadCloser, error) {
+	cached := s.stateCache.get(mac)
+	if cached != nil && s.clock.Now().Before(cached.expires) {
+		return io.NopCloser(bytes.NewReader(cached.data)), nil
+	}
+
+	uri := fmt.Sprintf("/resources/%s/%016x", strres(storage.StorageResourceState), mac)
+	rq := &request{op: opGet, method: "GET", path: uri}
+	if cached != nil && cached.etag != "" {
+		rq.header = http.Header{"If-None-Match": {cached.etag}}
+	}
+
+	r, err := s.sendRequest(ctx, rq)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	switch {
+	case r.StatusCode == http.StatusNotModified && cached != nil:
+		if expires, ok := freshness(r, s.clock.Now()); ok {
+			s.stateCache.set(mac, &cachedState{data: cached.data, etag: cached.etag, expires: expires})
+		} else {
+			s.stateCache.set(mac, nil)
+		}
+		return io.NopCloser(bytes.NewReader(cached.data)), nil
+	case r.StatusCode != http.StatusOK:
+		return nil, s.statusError(r)
+	}
+
+	data, err := io.ReadAll(s.downloadLimiter.reader(ctx, r.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	// without an ETag, an expired entry can't be revalidated and is
+	// of no use.
+	expires, ok := freshness(r, s.clock.Now())
+	etag := r.Header.Get("ETag")
+	if ok && (etag != "" || s.clock.Now().Before(expires)) {
+		s.stateCache.set(mac, &cachedState{data: data, etag: etag, expires: expires})
+	} else {
+		s.stateCache.set(mac, nil)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// cacheServer serves the state "v<version>" with the given
+// Cache-Control, and its ETag.
+type cacheServer struct {
+	mu           sync.Mutex
+	cacheControl string
+	expires      string
+	version      int
+	gets         int
+	revalidated  int
+}
+
+func (c *cacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	io.Copy(io.Discard, r.Body)
+	if r.Method != http.MethodGet {
+		c.version++
+		return
+	}
+	c.gets++
+	etag := strconv.Quote(strconv.Itoa(c.version))
+	if c.cacheControl != "" {
+		w.Header().Set("Cache-Control", c.cacheControl)
+	}
+	if c.expires != "" {
+		w.Header().Set("Expires", c.expires)
+	}
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		c.revalidated++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write([]byte("v" + etag))
+}
+
+func (c *cacheServer) counts() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gets, c.revalidated
+}
+
+func readState(t *testing.T, s *Store) string {
+	t.Helper()
+	rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStateCacheMaxAge(t *testing.T) {
+	h := &cacheServer{cacheControl: "max-age=60"}
+	clk := newFakeClock()
+	s, _ := newTestStoreClock(t, h, map[string]string{"state_cache": "true"}, clk)
+
+	for range 3 {
+		if data := readState(t, s); data != `v"0"` {
+			t.Fatalf("got %q", data)
+		}
+	}
+	if gets, _ := h.counts(); gets != 1 {
+		t.Fatalf("3 reads within max-age made %d requests, want 1", gets)
+	}
+
+	clk.Advance(61 * time.Second)
+	if data := readState(t, s); data != `v"0"` {
+		t.Fatalf("revalidated state: got %q", data)
+	}
+	if gets, revalidated := h.counts(); gets != 2 || revalidated != 1 {
+		t.Fatalf("read after max-age: %d requests and %d revalidations, want 2 and 1", gets, revalidated)
+	}
+
+	// the 304 made it fresh again
+	readState(t, s)
+	if gets, _ := h.counts(); gets != 2 {
+		t.Fatalf("read after revalidation made %d requests in all, want 2", gets)
+	}
+
+	// the store's own writes drop the entry
+	if _, err := s.Put(context.Background(), storage.StorageResourceState, objects.MAC{1}, bytes.NewReader([]byte("new"))); err != nil {
+		t.Fatal(err)
+	}
+	if data := readState(t, s); data != `v"1"` {
+		t.Fatalf("read after Put: got %q, want the new state", data)
+	}
+}
+
+func TestStateCacheAge(t *testing.T) {
+	h := &cacheServer{cacheControl: "max-age=60"}
+	clk := newFakeClock()
+	s, _ := newTestStoreClock(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Age", "50")
+		h.ServeHTTP(w, r)
+	}), map[string]string{"state_cache": "true"}, clk)
+
+	readState(t, s)
+	clk.Advance(20 * time.Second)
+	readState(t, s)
+	if gets, _ := h.counts(); gets != 2 {
+		t.Fatalf("read 20s later of a state 50s into its 60s max-age made %d requests in all, want 2", gets)
+	}
+}
+
+func TestStateCacheExpires(t *testing.T) {
+	clk := newFakeClock()
+	h := &cacheServer{expires: clk.Now().Add(30 * time.Second).Format(http.TimeFormat)}
+	s, _ := newTestStoreClock(t, h, map[string]string{"state_cache": "true"}, clk)
+
+	readState(t, s)
+	clk.Advance(29 * time.Second)
+	readState(t, s)
+	if gets, _ := h.counts(); gets != 1 {
+		t.Fatalf("read before Expires made %d requests in all, want 1", gets)
+	}
+	clk.Advance(2 * time.Second)
+	readState(t, s)
+	if gets, revalidated := h.counts(); gets != 2 || revalidated != 1 {
+		t.Fatalf("read after Expires: %d requests and %d revalidations, want 2 and 1", gets, revalidated)
+	}
+}
+
+func TestStateCacheNotCached(t *testing.T) {
+	for _, test := range []struct {
+		cacheControl string
+		config       string
+		revalidated  int
+	}{
+		{"no-store, max-age=60", "true", 0},
+		{"no-cache", "true", 2},
+		{"", "true", 0},
+		{"max-age=60", "false", 0},
+	} {
+		h := &cacheServer{cacheControl: test.cacheControl}
+		s, _ := newTestStoreClock(t, h, map[string]string{"state_cache": test.config}, newFakeClock())
+		for range 3 {
+			if data := readState(t, s); data != `v"0"` {
+				t.Fatalf("Cache-Control %q: got %q", test.cacheControl, data)
+			}
+		}
+		if gets, revalidated := h.counts(); gets != 3 || revalidated != test.revalidated {
+			t.Errorf("Cache-Control %q, state_cache %s: %d requests and %d revalidations, want 3 and %d",
+				test.cacheControl, test.config, gets, revalidated, test.revalidated)
+		}
+	}
+}
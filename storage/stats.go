@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of what the store did since it was opened.
+type Stats struct {
+	Requests        int64
+	Retries         int64
+	BytesUploaded   int64
+	BytesDownloaded int64
+
+	// keyed by the error class: "timeout", "network", "client_error"
+	// or "server_error"
+	Errors map[string]int64
+}
+
+type stats struct {
+	requests   atomic.Int64
+	retries    atomic.Int64
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+
+	mu     sync.Mutex
+	errors map[string]int64
+}
+
+func (st *stats) reset() {
+	st.requests.Store(0)
+	st.retries.Store(0)
+	st.uploaded.Store(0)
+	st.downloaded.Store(0)
+
+	st.mu.Lock()
+	st.errors = nil
+	st.mu.Unlock()
+}
+
+func (st *stats) recordError(class string) {
+	if class == "" {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.errors == nil {
+		st.errors = make(map[string]int64)
+	}
+	st.errors[class]++
+}
+
+func (s *Store) Stats() Stats {
+	st := &s.stats
+	st.mu.Lock()
+	errors := maps.Clone(st.errors)
+	st.mu.Unlock()
+	if errors == nil {
+		errors = make(map[string]int64)
+	}
+
+	return Stats{
+		Requests:        st.requests.Load(),
+		Retries:         st.retries.Load(),
+		BytesUploaded:   st.uploaded.Load(),
+		BytesDownloaded: st.downloaded.Load(),
+		Errors:          errors,
+	}
+}
+
+// errorClass sorts the outcome of an attempt, "" meaning it succeeded.
+func errorClass(r *http.Response, err error) string {
+	if err != nil {
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+	switch {
+	case r.StatusCode >= 500:
+		return "server_error"
+	case r.StatusCode >= 400:
+		return "client_error"
+	default:
+		return ""
+	}
+}
+
+// meteredReader adds whatever goes through it to a counter.
+type meteredReader struct {
+	rd io.Reader
+	n  *atomic.Int64
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	k, err := m.rd.Read(p)
+	m.n.Add(int64(k))
+	return k, err
+}
+
+type meteredReadCloser struct {
+	meteredReader
+	io.Closer
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestStats(t *testing.T) {
+	missing := objects.MAC{0xee}
+	flaky := objects.MAC{0xdd}
+	var flakyHits atomic.Int32
+	mem := &memServer{config: []byte("cfg")}
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, hex.EncodeToString(missing[:])):
+			w.WriteHeader(http.StatusNotFound)
+		case strings.HasSuffix(r.URL.Path, hex.EncodeToString(flaky[:])):
+			if flakyHits.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		default:
+			mem.ServeHTTP(w, r)
+		}
+	}), nil)
+	ctx := context.Background()
+
+	// whatever came before Open is not counted
+	if _, err := s.Get(ctx, storage.StorageResourcePackfile, missing, nil); err == nil {
+		t.Fatal("Get of a missing packfile succeeded")
+	}
+	if _, err := s.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Put(ctx, storage.StorageResourcePackfile, objects.MAC{byte(i)}, bytes.NewReader(make([]byte, 100))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, mac := range []objects.MAC{{1}, missing, flaky} {
+		rd, err := s.Get(ctx, storage.StorageResourcePackfile, mac, nil)
+		if err != nil {
+			if mac != missing {
+				t.Fatal(err)
+			}
+			continue
+		}
+		io.Copy(io.Discard, rd)
+		rd.Close()
+	}
+
+	got := s.Stats()
+	want := Stats{
+		Requests:        15,
+		Retries:         1,
+		BytesUploaded:   1000,
+		BytesDownloaded: 3 + 100 + 2,
+		Errors:          map[string]int64{"client_error": 1, "server_error": 1},
+	}
+	if got.Requests != want.Requests || got.Retries != want.Retries ||
+		got.BytesUploaded != want.BytesUploaded || got.BytesDownloaded != want.BytesDownloaded ||
+		!maps.Equal(got.Errors, want.Errors) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
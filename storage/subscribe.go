@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+type ChangeKind string
+
+const (
+	ChangeAdded   ChangeKind = "added"
+	ChangeRemoved ChangeKind = "removed"
+)
+
+type ChangeEvent struct {
+	Kind     ChangeKind
+	Resource storage.StorageResource
+	MAC      objects.MAC
+}
+
+// Subscribe streams the changes made to the repository, as the server
+// pushes them over server-sent events, until ctx is done or the server
+// ends the stream.  ErrUnsupported means the server has no such stream
+// and the caller should fall back to polling List.
+func (s *Store) Subscribe(ctx context.Context) (<-chan ChangeEvent, error) {
+	r, err := s.sendRequest(ctx, &request{
+		method: "GET",
+		path:   "/events",
+		header: http.Header{"Accept": {"text/event-stream"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if isUnsupported(r.StatusCode) {
+		r.Body.Close()
+		return nil, ErrUnsupported
+	}
+	if r.StatusCode != 200 {
+		defer r.Body.Close()
+		return nil, s.statusError(r)
+	}
+	if err := checkContentType(r, "text/event-stream"); err != nil {
+		r.Body.Close()
+		return nil, ErrUnsupported
+	}
+
+	ch := make(chan ChangeEvent)
+	go func() {
+		defer close(ch)
+		defer r.Body.Close()
+
+		readEvents(r.Body, func(ev sseEvent) bool {
+			kind := ChangeKind(ev.name)
+			if kind != ChangeAdded && kind != ChangeRemoved {
+				return true
+			}
+
+			var payload struct {
+				Resource string      `json:"resource"`
+				MAC      objects.MAC `json:"mac"`
+			}
+			if err := json.Unmarshal([]byte(ev.data), &payload); err != nil {
+				return true
+			}
+			res, ok := parseres(payload.Resource)
+			if !ok {
+				return true
+			}
+
+			select {
+			case ch <- ChangeEvent{Kind: kind, Resource: res, MAC: payload.MAC}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	return ch, nil
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestSubscribe(t *testing.T) {
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events" || r.Header.Get("Accept") != "text/event-stream" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		event := func(name, resource string, mac objects.MAC) {
+			data, _ := json.Marshal(map[string]any{"resource": resource, "mac": mac})
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+		}
+		fmt.Fprint(w, ": keepalive\n\n")
+		event("added", "packfiles", objects.MAC{1})
+		event("renamed", "packfiles", objects.MAC{2})
+		event("added", "nonsense", objects.MAC{3})
+		event("removed", "states", objects.MAC{4})
+	}), nil)
+
+	ch, err := s.Subscribe(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ChangeEvent{
+		{ChangeAdded, storage.StorageResourcePackfile, objects.MAC{1}},
+		{ChangeRemoved, storage.StorageResourceState, objects.MAC{4}},
+	}
+	var got []ChangeEvent
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				done = true
+				break
+			}
+			got = append(got, ev)
+		case <-timeout:
+			t.Fatal("the subscription did not end with the stream")
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+}
+
+func TestSubscribeUnsupported(t *testing.T) {
+	for name, h := range map[string]http.HandlerFunc{
+		"404": http.NotFound,
+		"html": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>"))
+		},
+	} {
+		s, _ := newTestStore(t, h, map[string]string{"max_retries": "0"})
+		if _, err := s.Subscribe(context.Background()); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: got %v, want ErrUnsupported", name, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// bandwidthLimiter paces transfers to a number of bytes per second.  It
+// is shared by all the requests of a store so the cap holds no matter
+// how many transfers run in parallel.
+type bandwidthLimiter struct {
+	clock clock
+	rate  int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newBandwidthLimiter(c clock, rate int64) *bandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{clock: c, rate: rate}
+}
+
+// wait books n bytes on the limiter and sleeps until they fit in the
+// configured rate.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := l.clock.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	return sleepContext(ctx, l.clock, delay)
+}
+
+// chunk is the largest read handed out at once, small enough that the
+// transfer is smooth rather than bursty.
+func (l *bandwidthLimiter) chunk() int {
+	return max(int(l.rate/10), 1)
+}
+
+type throttledReader struct {
+	ctx context.Context
+	rd  io.Reader
+	l   *bandwidthLimiter
+}
+
+func (l *bandwidthLimiter) reader(ctx context.Context, rd io.Reader) io.Reader {
+	if l == nil {
+		return rd
+	}
+	return &throttledReader{ctx: ctx, rd: rd, l: l}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.l.chunk() {
+		p = p[:t.l.chunk()]
+	}
+	k, err := t.rd.Read(p)
+	if k > 0 {
+		if werr := t.l.wait(t.ctx, k); werr != nil {
+			return k, werr
+		}
+	}
+	return k, err
+}
+
+type throttledReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (l *bandwidthLimiter) readCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if l == nil {
+		return rc
+	}
+	return &throttledReadCloser{Reader: l.reader(ctx, rc), Closer: rc}
+}
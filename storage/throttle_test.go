@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestBandwidthLimiterRate(t *testing.T) {
+	clk := newFakeClock()
+	l := newBandwidthLimiter(clk, 1000)
+	start := clk.Now()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, l.reader(context.Background(), bytes.NewReader(make([]byte, 5000))))
+		done <- err
+	}()
+	for range 5000 / l.chunk() {
+		d := clk.nextWait(t)
+		if d > 100*time.Millisecond {
+			t.Fatalf("waited %v for a %d bytes read, the transfer is bursty", d, l.chunk())
+		}
+		clk.Advance(d)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := clk.Now().Sub(start); got != 5*time.Second {
+		t.Errorf("5000 bytes at 1000 bytes/s took %v, want 5s", got)
+	}
+}
+
+func TestBandwidthLimiterCancel(t *testing.T) {
+	clk := newFakeClock()
+	l := newBandwidthLimiter(clk, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, l.reader(ctx, bytes.NewReader(make([]byte, 100))))
+		done <- err
+	}()
+	clk.nextWait(t)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the throttled read ignored the cancellation")
+	}
+}
+
+func TestBandwidthLimits(t *testing.T) {
+	const size, rate = 64 << 10, 256 << 10
+	want := time.Second * size / rate
+
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if r.Method == http.MethodGet {
+			w.Write(make([]byte, size))
+		}
+	}), map[string]string{
+		"max_upload_bandwidth":   "262144",
+		"max_download_bandwidth": "262144",
+	})
+	check := func(what string, start time.Time) {
+		t.Helper()
+		if got := time.Since(start); got < want*8/10 || got > want*3 {
+			t.Errorf("%s of %d bytes at %d bytes/s took %v, want about %v", what, size, rate, got, want)
+		}
+	}
+
+	start := time.Now()
+	if _, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, bytes.NewReader(make([]byte, size))); err != nil {
+		t.Fatal(err)
+	}
+	check("upload", start)
+
+	start = time.Now()
+	rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	if n, err := io.Copy(io.Discard, rd); err != nil || n != size {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+	check("download", start)
+}
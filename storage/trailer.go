@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// announcesTrailer tells whether r declared name as a trailer, which
+// a server streaming an object does for a digest it only knows at the
+// end.
+func announcesTrailer(r *http.Response, name string) bool {
+	_, ok := r.Trailer[http.CanonicalHeaderKey(name)]
+	return ok
+}
+
+// trailerDigestBody hashes a response as it is read and, once it is
+// read to the end, checks the hash against the digest the server sent
+// in its trailer.
+type trailerDigestBody struct {
+	r      *http.Response
+	header string
+	h      hash.Hash
+	io.ReadCloser
+}
+
+func newTrailerDigestBody(r *http.Response, algo integrityAlgo) *trailerDigestBody {
+	return &trailerDigestBody{r: r, header: algo.header, h: algo.new(), ReadCloser: r.Body}
+}
+
+func (t *trailerDigestBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.h.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+
+	remote := t.r.Trailer.Get(t.header)
+	if remote == "" {
+		return n, fmt.Errorf("server announced a %s trailer but didn't send it", t.header)
+	}
+	if local := hex.EncodeToString(t.h.Sum(nil)); !strings.EqualFold(remote, local) {
+		return n, fmt.Errorf("digest mismatch: server sent %s, got %s", remote, local)
+	}
+	return n, io.EOF
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestTrailerDigest(t *testing.T) {
+	data := strings.Repeat("streamed packfile ", 1000)
+	sum := sha256.Sum256([]byte(data))
+	for _, test := range []struct {
+		trailer string
+		err     string
+	}{
+		{hex.EncodeToString(sum[:]), ""},
+		{strings.ToUpper(hex.EncodeToString(sum[:])), ""},
+		{strings.Repeat("00", 32), "digest mismatch"},
+		{"", "didn't send it"},
+	} {
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Content-Sha256")
+			io.WriteString(w, data)
+			w.(http.Flusher).Flush()
+			if test.trailer != "" {
+				w.Header().Set("X-Content-Sha256", test.trailer)
+			}
+		}), nil)
+
+		rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rd)
+		rd.Close()
+		switch {
+		case test.err == "" && (err != nil || string(got) != data):
+			t.Errorf("trailer %q: read %d bytes, %v", test.trailer, len(got), err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("trailer %q: got %v, want %q", test.trailer, err, test.err)
+		}
+	}
+}
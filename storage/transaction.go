@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const transactionHeader = "X-Transaction-Id"
+
+// opTransaction marks the requests managing the transaction itself,
+// which are not made part of it.
+const opTransaction = "transaction"
+
+// transaction groups the writes of a store on servers that apply them
+// atomically: it is begun on the first write and committed on Close,
+// or rolled back if one of the writes failed.
+type transaction struct {
+	mu          sync.Mutex
+	id          string
+	unsupported bool
+	failed      bool
+}
+
+// beginTransaction opens the transaction if not done yet and returns its id, ""
+// when the server has no transactions and writes go out as they come.
+func (s *Store) beginTransaction(ctx context.Context) (string, error) {
+	tx := s.tx
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.id != "" || tx.unsupported {
+		return tx.id, nil
+	}
+
+	reply, err := doRequest[struct {
+		ID string `json:"id"`
+	}](ctx, s, &request{op: opTransaction, method: "POST", path: "/transactions"})
+	var serr *statusErr
+	if errors.As(err, &serr) && isUnsupported(serr.status) {
+		s.logger.Warn("server has no transactions, writing without one")
+		tx.unsupported = true
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("beginning transaction: %w", err)
+	}
+	if reply.ID == "" {
+		return "", fmt.Errorf("beginning transaction: server sent no id")
+	}
+	tx.id = reply.ID
+	return tx.id, nil
+}
+
+func (s *Store) transactionID() string {
+	if s.tx == nil {
+		return ""
+	}
+	s.tx.mu.Lock()
+	defer s.tx.mu.Unlock()
+	return s.tx.id
+}
+
+// noteWrite dooms the transaction once a write failed.
+func (tx *transaction) noteWrite(err error) {
+	if tx == nil || err == nil {
+		return
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.failed = true
+}
+
+// Rollback discards every write made in the transaction so far, the
+// following ones go into a new one.
+func (s *Store) Rollback(ctx context.Context) error {
+	return s.endTransaction(ctx, false)
+}
+
+// endTransaction commits or rolls back the transaction, if one was
+// begun.  A transaction in which a write failed is never committed.
+func (s *Store) endTransaction(ctx context.Context, commit bool) error {
+	if s.tx == nil {
+		return nil
+	}
+	tx := s.tx
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.id == "" {
+		return nil
+	}
+	id, failed := tx.id, tx.failed
+	tx.id, tx.failed = "", false
+
+	path := "/transactions/" + id
+	rq := &request{op: opTransaction, method: "DELETE", path: path}
+	if commit && !failed {
+		rq = &request{op: opTransaction, method: "POST", path: path + "/commit"}
+	}
+	if _, err := doRequest[struct{}](ctx, s, rq); err != nil {
+		return fmt.Errorf("ending transaction %s: %w", id, err)
+	}
+	if commit && failed {
+		return fmt.Errorf("transaction %s rolled back after a failed write", id)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// txServer applies the writes made in a transaction once it is
+// committed.  Uploads of "bad" fail.
+type txServer struct {
+	noTransactions bool
+
+	mu        sync.Mutex
+	next      int
+	committed map[string]string
+	pending   map[string]map[string]string
+	log       []string
+}
+
+func (x *txServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, _ := io.ReadAll(r.Body)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.committed == nil {
+		x.committed = make(map[string]string)
+		x.pending = make(map[string]map[string]string)
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/transactions") {
+		x.log = append(x.log, r.Method+" "+r.URL.Path)
+		if x.noTransactions {
+			http.NotFound(w, r)
+			return
+		}
+		id, commit := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/transactions/"), "/commit")
+		switch {
+		case r.URL.Path == "/transactions":
+			x.next++
+			id := fmt.Sprintf("tx%d", x.next)
+			x.pending[id] = make(map[string]string)
+			fmt.Fprintf(w, `{"id": %q}`, id)
+		case commit:
+			for path, obj := range x.pending[id] {
+				x.committed[path] = obj
+			}
+			delete(x.pending, id)
+			w.Write([]byte("{}"))
+		case r.Method == http.MethodDelete:
+			delete(x.pending, id)
+			w.Write([]byte("{}"))
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.Header.Get(transactionHeader) != "" {
+			http.Error(w, "read in a transaction", http.StatusBadRequest)
+			return
+		}
+		obj, ok := x.committed[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(obj))
+	case http.MethodPut:
+		if string(data) == "bad" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		id := r.Header.Get(transactionHeader)
+		if id == "" {
+			x.committed[r.URL.Path] = string(data)
+			return
+		}
+		tx, ok := x.pending[id]
+		if !ok {
+			http.Error(w, "no such transaction", http.StatusConflict)
+			return
+		}
+		tx[r.URL.Path] = string(data)
+	}
+}
+
+func (x *txServer) visible() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var ret []string
+	for _, obj := range x.committed {
+		ret = append(ret, obj)
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+func (x *txServer) transactions() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return slices.Clone(x.log)
+}
+
+func newTxStore(t *testing.T, x *txServer) *Store {
+	t.Helper()
+	s, _ := newTestStore(t, x, map[string]string{"transactions": "true", "max_retries": "0"})
+	s.logger = slog.New(slog.DiscardHandler)
+	return s
+}
+
+func putObject(s *Store, mac byte, data string) error {
+	_, err := s.Put(context.Background(), storage.StorageResourcePackfile, objects.MAC{mac}, bytes.NewReader([]byte(data)))
+	return err
+}
+
+func TestTransactionCommit(t *testing.T) {
+	x := &txServer{}
+	s := newTxStore(t, x)
+
+	for i, data := range []string{"one", "two"} {
+		if err := putObject(s, byte(i), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := x.visible(); len(got) != 0 {
+		t.Fatalf("%q visible before the commit", got)
+	}
+	if _, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{0}, nil); err == nil {
+		t.Fatal("read an object not committed yet")
+	}
+
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := x.visible(); !slices.Equal(got, []string{"one", "two"}) {
+		t.Errorf("visible after the commit: %q", got)
+	}
+	if got := x.transactions(); !slices.Equal(got, []string{"POST /transactions", "POST /transactions/tx1/commit"}) {
+		t.Errorf("transaction requests %q", got)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	x := &txServer{}
+	s := newTxStore(t, x)
+
+	if err := putObject(s, 1, "discarded"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rollback(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := putObject(s, 2, "kept"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := x.visible(); !slices.Equal(got, []string{"kept"}) {
+		t.Errorf("visible after a rollback and a commit: %q", got)
+	}
+	want := []string{"POST /transactions", "DELETE /transactions/tx1", "POST /transactions", "POST /transactions/tx2/commit"}
+	if got := x.transactions(); !slices.Equal(got, want) {
+		t.Errorf("transaction requests %q, want %q", got, want)
+	}
+}
+
+func TestTransactionFailedWrite(t *testing.T) {
+	x := &txServer{}
+	s := newTxStore(t, x)
+
+	if err := putObject(s, 1, "good"); err != nil {
+		t.Fatal(err)
+	}
+	if err := putObject(s, 2, "bad"); err == nil {
+		t.Fatal("failing upload got no error")
+	}
+	if err := s.Close(context.Background()); err == nil || !strings.Contains(err.Error(), "rolled back") {
+		t.Fatalf("Close after a failed write: got %v, want the transaction rolled back", err)
+	}
+	if got := x.visible(); len(got) != 0 {
+		t.Errorf("%q visible after a rolled back transaction", got)
+	}
+}
+
+func TestTransactionUnsupported(t *testing.T) {
+	x := &txServer{noTransactions: true}
+	s := newTxStore(t, x)
+
+	for i, data := range []string{"one", "two"} {
+		if err := putObject(s, byte(i), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := x.visible(); !slices.Equal(got, []string{"one", "two"}) {
+		t.Errorf("visible without transactions: %q, want the writes as they come", got)
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := x.transactions(); len(got) != 1 {
+		t.Errorf("transaction requests %q, want a single attempt", got)
+	}
+}
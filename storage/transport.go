@@ -0,0 +1,300 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// defaultMaxHeaderBytes is well above what any sane server sends, and
+// far below the megabyte the standard transport puts up with.
+const defaultMaxHeaderBytes = 64 << 10
+
+// sharedTransports are the pools of the stores configured with
+// connection_pool=shared.
+var (
+	sharedMu         sync.Mutex
+	sharedTransports = make(map[string]*http.Transport)
+)
+
+// sharedTransport hands out the transport of the stores going to host
+// with the same settings, creating it on first use.
+func sharedTransport(host string, tc transportConfig) *http.Transport {
+	key := fmt.Sprintf("%s|%+v", host, tc)
+
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	tr, ok := sharedTransports[key]
+	if !ok {
+		tr = newTransport(tc)
+		sharedTransports[key] = tr
+	}
+	return tr
+}
+
+type transportConfig struct {
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	maxConns     int
+	idleTimeout  time.Duration
+	keepAlive    time.Duration
+	maxHeaders   int64
+
+	negotiate NegotiateProvider
+	tunnel    string // kept as a string so that the config prints as a pool key
+
+	// presented over TLS, and checked against the certificate, in
+	// place of serverNameHost
+	serverName     string
+	serverNameHost string
+
+	renegotiation tls.RenegotiationSupport
+
+	// every store gets its own pool unless shared
+	shared bool
+}
+
+func parseTransportConfig(storeConfig map[string]string) (transportConfig, error) {
+	var tc transportConfig
+	var err error
+
+	if tc.readTimeout, err = parseDuration(storeConfig, "read_timeout"); err != nil {
+		return tc, err
+	}
+	if tc.writeTimeout, err = parseDuration(storeConfig, "write_timeout"); err != nil {
+		return tc, err
+	}
+	if tc.maxConns, err = parseCount(storeConfig, "max_connections"); err != nil {
+		return tc, err
+	}
+	if tc.idleTimeout, err = parseDuration(storeConfig, "idle_conn_timeout"); err != nil {
+		return tc, err
+	}
+	if tc.keepAlive, err = parseDuration(storeConfig, "tcp_keepalive"); err != nil {
+		return tc, err
+	}
+	tc.maxHeaders = defaultMaxHeaderBytes
+	if _, ok := storeConfig["max_response_header_bytes"]; ok {
+		if tc.maxHeaders, err = parseSize(storeConfig, "max_response_header_bytes"); err != nil {
+			return tc, err
+		}
+	}
+	if tc.negotiate, err = parseProxyAuth(storeConfig); err != nil {
+		return tc, err
+	}
+	tc.serverName = storeConfig["tls_server_name"]
+	if tunnel, err := parseProxyTunnel(storeConfig); err != nil {
+		return tc, err
+	} else if tunnel != nil {
+		tc.tunnel = tunnel.String()
+	}
+	switch value := storeConfig["tls_renegotiation"]; value {
+	case "", "never":
+		tc.renegotiation = tls.RenegotiateNever
+	case "once":
+		tc.renegotiation = tls.RenegotiateOnceAsClient
+	case "freely":
+		tc.renegotiation = tls.RenegotiateFreelyAsClient
+	default:
+		return tc, fmt.Errorf("invalid tls_renegotiation %q: expected never, once or freely", value)
+	}
+	switch value := storeConfig["connection_pool"]; value {
+	case "", "store":
+	case "shared":
+		tc.shared = true
+	default:
+		return tc, fmt.Errorf("invalid connection_pool %q: expected store or shared", value)
+	}
+	return tc, nil
+}
+
+func newTransport(tc transportConfig) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+
+	// idle connections are dropped before some middlebox silently
+	// does, so the next request dials fresh instead of failing once.
+	if tc.idleTimeout > 0 {
+		tr.IdleConnTimeout = tc.idleTimeout
+	}
+
+	if tc.maxHeaders > 0 {
+		tr.MaxResponseHeaderBytes = tc.maxHeaders
+	}
+
+	// dialTLS starts from this config too, so a tls_server_name
+	// connection renegotiates alike.
+	if tc.renegotiation != tls.RenegotiateNever {
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		tr.TLSClientConfig.Renegotiation = tc.renegotiation
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	// KeepAlive alone only sets the idle time before the first probe,
+	// the probes after it would still go out every 15s.
+	if tc.keepAlive > 0 {
+		dialer.KeepAliveConfig = net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     tc.keepAlive,
+			Interval: tc.keepAlive,
+		}
+	}
+
+	// a CONNECT tunnel can't be replayed on a challenge, so https
+	// targets authenticate to the proxy up front.
+	if tc.negotiate != nil {
+		tr.GetProxyConnectHeader = func(ctx context.Context, proxyURL *url.URL, target string) (http.Header, error) {
+			token, err := tc.negotiate.Token(ctx, proxyURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			return http.Header{"Proxy-Authorization": {negotiateHeader(token)}}, nil
+		}
+	}
+
+	// every connection goes through the tunnel, the environment's
+	// proxy settings would only get in the way.
+	var tunnel *url.URL
+	if tc.tunnel != "" {
+		tunnel, _ = url.Parse(tc.tunnel)
+		tr.Proxy = nil
+	}
+
+	// MaxConnsPerHost only holds per host, the semaphore caps the
+	// whole transport.
+	var slots chan struct{}
+	if tc.maxConns > 0 {
+		tr.MaxConnsPerHost = tc.maxConns
+		slots = make(chan struct{}, tc.maxConns)
+	}
+
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if slots != nil {
+			if err := acquireSlot(ctx, tr, slots); err != nil {
+				return nil, err
+			}
+		}
+
+		var conn net.Conn
+		var err error
+		if tunnel != nil {
+			conn, err = dialTunnel(ctx, dialer, tunnel, tc.negotiate, addr)
+		} else {
+			conn, err = dialer.DialContext(ctx, network, addr)
+		}
+		if err != nil {
+			if slots != nil {
+				<-slots
+			}
+			return nil, err
+		}
+		if slots != nil {
+			conn = &slotConn{Conn: conn, slots: slots}
+		}
+		if tc.readTimeout == 0 && tc.writeTimeout == 0 {
+			return conn, nil
+		}
+		return &deadlineConn{Conn: conn, read: tc.readTimeout, write: tc.writeTimeout}, nil
+	}
+	if tc.serverName != "" {
+		tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTLS(ctx, tr, tc, network, addr)
+		}
+	}
+	return tr
+}
+
+// slotPoll is how often idle connections are dropped while waiting
+// for a slot.
+const slotPoll = 50 * time.Millisecond
+
+// acquireSlot waits for one of the connection slots.  An idle pooled
+// connection holds its slot, and the transport only hands one over to
+// a request for the same host: for as long as the wait lasts, the idle
+// connections are dropped so that a request to another host, say a CDN
+// the server redirected to, gets their slot.
+func acquireSlot(ctx context.Context, tr *http.Transport, slots chan struct{}) error {
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	tick := time.NewTicker(slotPoll)
+	defer tick.Stop()
+	for {
+		tr.CloseIdleConnections()
+		select {
+		case slots <- struct{}{}:
+			return nil
+		case <-tick.C:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for one of %d connections: %w", cap(slots), ctx.Err())
+		}
+	}
+}
+
+// slotConn gives its slot back when closed.
+type slotConn struct {
+	net.Conn
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (c *slotConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.slots })
+	return err
+}
+
+// deadlineConn pushes the socket deadlines forward on every read and
+// write, so a connection that stops moving data fails on its own
+// instead of waiting for the whole request to time out.
+type deadlineConn struct {
+	net.Conn
+	read  time.Duration
+	write time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.read > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.read)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.write > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.write)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"syscall"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// keepAlive reads the keepalive idle time and probe interval, in
+// seconds, off the socket of a new connection of s.
+func keepAlive(t *testing.T, s *Store) (idle, interval int) {
+	t.Helper()
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			raw, err := info.Conn.(*net.TCPConn).SyscallConn()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			raw.Control(func(fd uintptr) {
+				idle, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+				interval, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+			})
+		},
+	})
+
+	rd, err := s.Get(ctx, storage.StorageResourceState, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, rd)
+	rd.Close()
+	return idle, interval
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	for _, test := range []struct {
+		keepalive      string
+		idle, interval int
+	}{
+		{"7s", 7, 7},
+		{"", 30, 15},
+	} {
+		config := map[string]string{}
+		if test.keepalive != "" {
+			config["tcp_keepalive"] = test.keepalive
+		}
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config)
+		idle, interval := keepAlive(t, s)
+		if idle != test.idle || interval != test.interval {
+			t.Errorf("tcp_keepalive=%q: first probe after %ds then every %ds, want %ds and %ds",
+				test.keepalive, idle, interval, test.idle, test.interval)
+		}
+	}
+}
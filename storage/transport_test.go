@@ -0,0 +1,357 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+func TestReadTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "8")
+		w.Write([]byte("half"))
+		w.(http.Flusher).Flush()
+		<-stall
+	}), map[string]string{"read_timeout": "100ms", "max_retries": "0"})
+	t.Cleanup(func() { close(stall) })
+
+	rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(rd)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Errorf("stalled read: got %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled read went past read_timeout")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	var mu sync.Mutex
+	open, most := 0, 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch state {
+		case http.StateNew:
+			open++
+			most = max(most, open)
+		case http.StateClosed, http.StateHijacked:
+			open--
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	s, err := newStore(map[string]string{"location": srv.URL, "max_connections": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close(context.Background()) })
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rd, err := s.Get(context.Background(), storage.StorageResourcePackfile, objects.MAC{byte(i)}, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			io.Copy(io.Discard, rd)
+			rd.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if most > 2 {
+		t.Errorf("%d connections open at once, want at most 2", most)
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	for _, test := range []struct {
+		pool  string
+		conns int32
+	}{
+		{"store", 2},
+		{"shared", 1},
+	} {
+		var conns atomic.Int32
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		}
+		srv.Start()
+		t.Cleanup(srv.Close)
+
+		var stores []*Store
+		for range 2 {
+			s, err := newStore(map[string]string{"location": srv.URL, "connection_pool": test.pool})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close(context.Background()) })
+			stores = append(stores, s)
+		}
+		if shared := stores[0].transport == stores[1].transport; shared != (test.pool == "shared") {
+			t.Errorf("connection_pool=%s: transports shared %v", test.pool, shared)
+		}
+
+		for _, s := range stores {
+			rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, rd)
+			rd.Close()
+		}
+		if n := conns.Load(); n != test.conns {
+			t.Errorf("connection_pool=%s: %d connections for two stores, want %d", test.pool, n, test.conns)
+		}
+	}
+}
+
+func TestConnectionPoolSettings(t *testing.T) {
+	a, err := newStore(map[string]string{"location": "http://example.com/a", "connection_pool": "shared"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close(context.Background())
+	b, err := newStore(map[string]string{"location": "http://example.com/b", "connection_pool": "shared", "read_timeout": "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close(context.Background())
+	if a.transport == b.transport {
+		t.Error("stores with different settings share a pool")
+	}
+}
+
+func TestConnectionPoolValidate(t *testing.T) {
+	sharedMu.Lock()
+	before := len(sharedTransports)
+	sharedMu.Unlock()
+
+	if err := ValidateConfig(map[string]string{"location": "http://validated.example.com", "connection_pool": "shared"}); err != nil {
+		t.Fatal(err)
+	}
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if n := len(sharedTransports); n != before {
+		t.Errorf("%d shared pools after validating a config, %d before", n, before)
+	}
+}
+
+func TestIdleConnTimeout(t *testing.T) {
+	for _, test := range []struct {
+		timeout string
+		conns   int32
+	}{
+		{"50ms", 2},
+		{"", 1},
+	} {
+		var conns, closed atomic.Int32
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				conns.Add(1)
+			case http.StateClosed:
+				closed.Add(1)
+			}
+		}
+		srv.Start()
+		t.Cleanup(srv.Close)
+
+		config := map[string]string{"location": srv.URL}
+		if test.timeout != "" {
+			config["idle_conn_timeout"] = test.timeout
+		}
+		s, err := newStore(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close(context.Background()) })
+
+		for i := range 2 {
+			if i == 1 {
+				time.Sleep(200 * time.Millisecond)
+				if test.timeout != "" && closed.Load() != 1 {
+					t.Errorf("idle_conn_timeout=%s: the idle connection is still open", test.timeout)
+				}
+			}
+			rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, rd)
+			rd.Close()
+		}
+		if n := conns.Load(); n != test.conns {
+			t.Errorf("idle_conn_timeout=%q: %d connections, want %d", test.timeout, n, test.conns)
+		}
+	}
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	for _, test := range []struct {
+		limit string
+		size  int
+		ok    bool
+	}{
+		{"", 32 << 10, true},
+		{"", 128 << 10, false},
+		{"4096", 8 << 10, false},
+		{"1048576", 128 << 10, true},
+	} {
+		config := map[string]string{"max_retries": "0"}
+		if test.limit != "" {
+			config["max_response_header_bytes"] = test.limit
+		}
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Padding", strings.Repeat("x", test.size))
+		}), config)
+
+		rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+		if err == nil {
+			rd.Close()
+		}
+		if test.ok && err != nil {
+			t.Errorf("limit %q, %d bytes of headers: %v", test.limit, test.size, err)
+		} else if !test.ok && (err == nil || !strings.Contains(err.Error(), "header")) {
+			t.Errorf("limit %q, %d bytes of headers: got %v, want them refused", test.limit, test.size, err)
+		}
+	}
+}
+
+func TestTLSRenegotiation(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  tls.RenegotiationSupport
+	}{
+		{"", tls.RenegotiateNever},
+		{"never", tls.RenegotiateNever},
+		{"once", tls.RenegotiateOnceAsClient},
+		{"freely", tls.RenegotiateFreelyAsClient},
+	} {
+		config := map[string]string{"location": "https://localhost"}
+		if test.value != "" {
+			config["tls_renegotiation"] = test.value
+		}
+		s, err := newStore(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := tls.RenegotiateNever
+		if cfg := s.transport.TLSClientConfig; cfg != nil {
+			got = cfg.Renegotiation
+		}
+		if got != test.want {
+			t.Errorf("tls_renegotiation %q: transport renegotiates %v, want %v", test.value, got, test.want)
+		}
+		s.Close(context.Background())
+	}
+
+	if _, err := newStore(map[string]string{"location": "https://localhost", "tls_renegotiation": "always"}); err == nil {
+		t.Error("an unknown tls_renegotiation was accepted")
+	}
+}
+
+func TestTLSRenegotiationHandshake(t *testing.T) {
+	// renegotiation only exists up to TLS 1.2
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	for _, config := range []map[string]string{
+		{"tls_renegotiation": "once"},
+		{"tls_renegotiation": "freely", "tls_server_name": "example.com"},
+	} {
+		s := newSNIStore(t, srv, config)
+		if err := getState(s); err != nil {
+			t.Errorf("%v: %v", config, err)
+		}
+	}
+}
+
+func TestMaxConnectionsOtherHost(t *testing.T) {
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from the cdn"))
+	}))
+	t.Cleanup(cdn.Close)
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, cdn.URL+r.URL.Path, http.StatusFound)
+	}), map[string]string{"max_connections": "1", "max_retries": "0"})
+
+	// the connection to the server sits idle in the pool while the
+	// redirect is followed
+	for range 2 {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		rd, err := s.Get(ctx, storage.StorageResourcePackfile, objects.MAC{1}, nil)
+		if err != nil {
+			cancel()
+			t.Fatalf("redirect to another host with max_connections=1: %v", err)
+		}
+		data, err := io.ReadAll(rd)
+		rd.Close()
+		cancel()
+		if err != nil || string(data) != "from the cdn" {
+			t.Fatalf("got %q, %v", data, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// connectProxy tunnels CONNECT requests to their target, and refuses
+// anything else.
+type connectProxy struct {
+	auth string
+
+	mu      sync.Mutex
+	targets []string
+	creds   []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.targets = append(p.targets, r.Host)
+	p.creds = append(p.creds, r.Header.Get("Proxy-Authorization"))
+	p.mu.Unlock()
+
+	if r.Method != "CONNECT" {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.auth != "" && r.Header.Get("Proxy-Authorization") != p.auth {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	backend, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		backend.Close()
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go func() {
+		io.Copy(backend, conn)
+		backend.Close()
+	}()
+	io.Copy(conn, backend)
+	conn.Close()
+}
+
+func (p *connectProxy) seen() ([]string, []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.targets, p.creds
+}
+
+func newTunnelStore(t *testing.T, backend *httptest.Server, proxy string) *Store {
+	t.Helper()
+	s, err := newStore(map[string]string{"location": backend.URL, "proxy_tunnel": proxy, "max_retries": "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close(context.Background()) })
+	if backend.TLS != nil {
+		if s.transport.TLSClientConfig == nil {
+			s.transport.TLSClientConfig = &tls.Config{}
+		}
+		s.transport.TLSClientConfig.RootCAs = backend.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	}
+	return s
+}
+
+func TestProxyTunnel(t *testing.T) {
+	for _, newServer := range []func(http.Handler) *httptest.Server{httptest.NewServer, httptest.NewTLSServer} {
+		backend := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		t.Cleanup(backend.Close)
+		proxy := &connectProxy{}
+		proxySrv := httptest.NewServer(proxy)
+		t.Cleanup(proxySrv.Close)
+
+		s := newTunnelStore(t, backend, proxySrv.URL)
+		if err := getState(s); err != nil {
+			t.Fatalf("%s through the tunnel: %v", backend.URL, err)
+		}
+		targets, creds := proxy.seen()
+		want := strings.TrimPrefix(strings.TrimPrefix(backend.URL, "http://"), "https://")
+		if len(targets) != 1 || targets[0] != want {
+			t.Errorf("%s: proxy got CONNECT to %v, want one to %s", backend.URL, targets, want)
+		}
+		if creds[0] != "" {
+			t.Errorf("%s: proxy got credentials %q, none were configured", backend.URL, creds[0])
+		}
+	}
+}
+
+func TestProxyTunnelAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(backend.Close)
+	proxy := &connectProxy{auth: "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:pass"))}
+	proxySrv := httptest.NewServer(proxy)
+	t.Cleanup(proxySrv.Close)
+
+	s := newTunnelStore(t, backend, strings.Replace(proxySrv.URL, "http://", "http://alice:pass@", 1))
+	if err := getState(s); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTunnelStore(t, backend, strings.Replace(proxySrv.URL, "http://", "http://alice:wrong@", 1))
+	if err := getState(s); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("tunnel refused by the proxy: got %v, want the 407", err)
+	}
+}
+
+func TestProxyTunnelConfig(t *testing.T) {
+	for _, value := range []string{"https://proxy:3128", "proxy:3128", "http://"} {
+		if _, err := newStore(map[string]string{"location": "http://localhost", "proxy_tunnel": value}); err == nil {
+			t.Errorf("proxy_tunnel %q accepted", value)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+)
+
+// baseURL is where requests go: the configured location, unless it was
+// upgraded to https along the way.
+func (s *Store) baseURL() url.URL {
+	if u := s.upgraded.Load(); u != nil {
+		return *u
+	}
+	return *s.location
+}
+
+// upgradeTo switches every following request to https on host, that is
+// never undone.
+func (s *Store) upgradeTo(host string) {
+	u := *s.location
+	u.Scheme = "https"
+	u.Host = host
+	s.upgraded.Store(&u)
+	s.connEvent(ConnEndpointSwitched, u.Host)
+}
+
+// httpsHost is where the https side of the configured http location
+// lives.
+func (s *Store) httpsHost() string {
+	if s.httpsPort != "" {
+		return net.JoinHostPort(s.location.Hostname(), s.httpsPort)
+	}
+	return s.location.Hostname()
+}
+
+// shouldUpgrade tells whether a failed plain http attempt may be sent
+// again over https.
+func (s *Store) shouldUpgrade(err error) bool {
+	if !s.autoHTTPS || s.location.Scheme != "http" || s.upgraded.Load() != nil {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// noteRedirect upgrades the store for good once the server redirected
+// it to its own https side.
+func (s *Store) noteRedirect(req *http.Request, via []*http.Request) {
+	if s.upgraded.Load() == nil && s.isUpgradeRedirect(req, via) {
+		s.upgradeTo(req.URL.Host)
+	}
+}
+
+// isUpgradeRedirect tells a redirect from the http location to the
+// https side of the same host, which is still the storage server
+// whatever its port.
+func (s *Store) isUpgradeRedirect(req *http.Request, via []*http.Request) bool {
+	orig := via[0].URL
+	return s.autoHTTPS && orig.Scheme == "http" && req.URL.Scheme == "https" &&
+		req.URL.Hostname() == orig.Hostname()
+}
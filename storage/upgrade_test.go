@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// httpsServer only answers requests carrying the storage credentials,
+// logging their paths.
+type httpsServer struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (h *httpsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	h.mu.Lock()
+	h.paths = append(h.paths, r.URL.Path)
+	h.mu.Unlock()
+}
+
+func (h *httpsServer) hits() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.paths)
+}
+
+// newUpgradingStore points a store at location, trusting the
+// certificate of tlsSrv.
+func newUpgradingStore(t *testing.T, location string, tlsSrv *httptest.Server, config map[string]string) *Store {
+	t.Helper()
+	cfg := map[string]string{"location": location, "auth_token": "secret", "max_retries": "0"}
+	for k, v := range config {
+		cfg[k] = v
+	}
+	s, err := newStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close(context.Background()) })
+	if s.transport.TLSClientConfig == nil {
+		s.transport.TLSClientConfig = &tls.Config{}
+	}
+	s.transport.TLSClientConfig.RootCAs = tlsSrv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	return s
+}
+
+// closedPort is a local address nothing listens on.
+func closedPort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func getState(s *Store) error {
+	rd, err := s.Get(context.Background(), storage.StorageResourceState, objects.MAC{1}, nil)
+	if err == nil {
+		rd.Close()
+	}
+	return err
+}
+
+func TestAutoHTTPSRefused(t *testing.T) {
+	h := &httpsServer{}
+	tlsSrv := httptest.NewTLSServer(h)
+	t.Cleanup(tlsSrv.Close)
+	tlsURL, _ := url.Parse(tlsSrv.URL)
+
+	location := "http://" + closedPort(t) + "/repo"
+	s := newUpgradingStore(t, location, tlsSrv, map[string]string{"auto_https": "true", "https_port": tlsURL.Port()})
+	for range 2 {
+		if err := getState(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h.hits() != 2 {
+		t.Errorf("https side got %d requests, want 2", h.hits())
+	}
+	for _, path := range h.paths {
+		if !strings.HasPrefix(path, "/repo/resources/states/") {
+			t.Errorf("https side got %s, want the path kept", path)
+		}
+	}
+
+	off := newUpgradingStore(t, location, tlsSrv, map[string]string{"https_port": tlsURL.Port()})
+	if err := getState(off); err == nil {
+		t.Error("refused http connection upgraded without auto_https")
+	}
+}
+
+func TestAutoHTTPSRedirect(t *testing.T) {
+	h := &httpsServer{}
+	tlsSrv := httptest.NewTLSServer(h)
+	t.Cleanup(tlsSrv.Close)
+
+	var plain sync.Map
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plain.Store(r.URL.Path, true)
+		http.Redirect(w, r, tlsSrv.URL+r.URL.Path, http.StatusMovedPermanently)
+	}))
+	t.Cleanup(httpSrv.Close)
+
+	s := newUpgradingStore(t, httpSrv.URL, tlsSrv, map[string]string{"auto_https": "true"})
+	if err := getState(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := getState(s); err != nil {
+		t.Fatal(err)
+	}
+	if h.hits() != 2 {
+		t.Errorf("https side got %d requests, want 2", h.hits())
+	}
+	n := 0
+	plain.Range(func(any, any) bool { n++; return true })
+	if n != 1 {
+		t.Errorf("http side got %d requests, want only the first one before the upgrade", n)
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// Usage reports how many bytes the repository uses on the server and
+// how many are still free there, -1 for what the server doesn't say,
+// both when it has no /usage endpoint.
+func (s *Store) Usage(ctx context.Context) (used, free int64, err error) {
+	reply, err := doRequest[struct {
+		Used *int64 `json:"used"`
+		Free *int64 `json:"free"`
+	}](ctx, s, &request{method: "GET", path: "/usage"})
+	var serr *statusErr
+	if errors.As(err, &serr) && isUnsupported(serr.status) {
+		return -1, -1, nil
+	}
+	if err != nil {
+		return -1, -1, err
+	}
+
+	used, free = -1, -1
+	if reply.Used != nil {
+		used = *reply.Used
+	}
+	if reply.Free != nil {
+		free = *reply.Free
+	}
+	return used, free, nil
+}
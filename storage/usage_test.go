@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestUsage(t *testing.T) {
+	for _, test := range []struct {
+		status     int
+		body       string
+		used, free int64
+		fails      bool
+	}{
+		{http.StatusOK, `{"used": 1234, "free": 5678}`, 1234, 5678, false},
+		{http.StatusOK, `{"used": 1234}`, 1234, -1, false},
+		{http.StatusOK, `{"free": 0}`, -1, 0, false},
+		{http.StatusOK, `{}`, -1, -1, false},
+		{http.StatusNotFound, ``, -1, -1, false},
+		{http.StatusNotImplemented, ``, -1, -1, false},
+		{http.StatusForbidden, ``, -1, -1, true},
+		{http.StatusOK, `not json`, -1, -1, true},
+	} {
+		s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/usage" {
+				t.Errorf("usage asked at %s", r.URL.Path)
+			}
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}), map[string]string{"max_retries": "0"})
+
+		used, free, err := s.Usage(context.Background())
+		if (err != nil) != test.fails || used != test.used || free != test.free {
+			t.Errorf("%d %s: got %d, %d, %v, want %d, %d and failure %v",
+				test.status, test.body, used, free, err, test.used, test.free, test.fails)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+const serverVersionHeader = "X-Server-Version"
+
+// canonicalVersion turns "1.2.3" or "v1.2.3" into the form semver
+// compares, "" if it isn't a version.
+func canonicalVersion(v string) string {
+	if !strings.HasPrefix(v, "v") {
+		v = "v" + v
+	}
+	if !semver.IsValid(v) {
+		return ""
+	}
+	return semver.Canonical(v)
+}
+
+func parseVersionRange(storeConfig map[string]string) (lo, hi string, err error) {
+	for _, key := range []string{"server_version_min", "server_version_max"} {
+		value, ok := storeConfig[key]
+		if !ok {
+			continue
+		}
+		v := canonicalVersion(value)
+		if v == "" {
+			return "", "", fmt.Errorf("invalid %s %q: expected a version such as 1.2.0", key, value)
+		}
+		if key == "server_version_min" {
+			lo = v
+		} else {
+			hi = v
+		}
+	}
+	if lo != "" && hi != "" && semver.Compare(lo, hi) > 0 {
+		return "", "", fmt.Errorf("server_version_min %s is above server_version_max %s", lo, hi)
+	}
+	return lo, hi, nil
+}
+
+// ServerVersion is the version the server advertised in its last
+// response, "" if it never did.
+func (s *Store) ServerVersion() string {
+	if v := s.serverVersion.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
+
+// noteServerVersion records the version advertised by a response and
+// warns, once per version, when it is outside the compatible range.
+func (s *Store) noteServerVersion(r *http.Response) {
+	advertised := r.Header.Get(serverVersionHeader)
+	if advertised == "" {
+		return
+	}
+	if prev := s.serverVersion.Swap(&advertised); prev != nil && *prev == advertised {
+		return
+	}
+	if s.versionMin == "" && s.versionMax == "" {
+		return
+	}
+
+	v := canonicalVersion(advertised)
+	switch {
+	case v == "":
+		s.logger.Warn("server advertised an unparsable version", "version", advertised)
+	case s.versionMin != "" && semver.Compare(v, s.versionMin) < 0,
+		s.versionMax != "" && semver.Compare(v, s.versionMax) > 0:
+		s.logger.Warn("server version outside the compatible range",
+			"version", advertised,
+			"min", s.versionMin,
+			"max", s.versionMax)
+	}
+}
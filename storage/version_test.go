@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestServerVersionSkew(t *testing.T) {
+	var mu sync.Mutex
+	version := ""
+	s, _ := newTestStore(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if version != "" {
+			w.Header().Set(serverVersionHeader, version)
+		}
+	}), map[string]string{"server_version_min": "1.2", "server_version_max": "v1.4.0"})
+	logs := &logRecorder{}
+	s.logger = slog.New(logs)
+
+	for _, test := range []struct {
+		version string
+		warn    bool
+	}{
+		{"", false},
+		{"1.3.7", false},
+		{"1.5.0", true},
+		{"1.5.0", false}, // once per version
+		{"v1.1.9", true},
+		{"1.4.0", false},
+		{"latest", true},
+	} {
+		mu.Lock()
+		version = test.version
+		mu.Unlock()
+		logs.mu.Lock()
+		logs.records = nil
+		logs.mu.Unlock()
+
+		if _, err := s.Open(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.ServerVersion(); got != test.version {
+			t.Errorf("ServerVersion is %q, want %q", got, test.version)
+		}
+		logs.mu.Lock()
+		if warned := len(logs.records) != 0; warned != test.warn {
+			t.Errorf("version %q: warned %v, want %v", test.version, warned, test.warn)
+		}
+		for _, rec := range logs.records {
+			if rec.Level != slog.LevelWarn {
+				t.Errorf("version %q: logged %q at %v", test.version, rec.Message, rec.Level)
+			}
+		}
+		logs.mu.Unlock()
+	}
+}
+
+func TestServerVersionRangeInvalid(t *testing.T) {
+	for _, config := range []map[string]string{
+		{"server_version_min": "one"},
+		{"server_version_max": "1.x"},
+		{"server_version_min": "2.0", "server_version_max": "1.9"},
+	} {
+		config["location"] = "http://example.com"
+		if err := ValidateConfig(config); err == nil {
+			t.Errorf("%v accepted", config)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// ListSince lists the objects of res added after watermark, which is
+// what an earlier call returned or "" for everything, along with the
+// watermark to pass next time.  A server without watermarks sends its
+// full listing and no watermark, so the delta may hold objects already
+// known of; one that has forgotten watermark, with a 410, gets a full
+// listing asked for.
+func (s *Store) ListSince(ctx context.Context, res storage.StorageResource, watermark string) ([]objects.MAC, string, error) {
+	macs, next, err := s.listSince(ctx, res, watermark)
+	var serr *statusErr
+	if watermark != "" && errors.As(err, &serr) && serr.status == http.StatusGone {
+		return s.listSince(ctx, res, "")
+	}
+	return macs, next, err
+}
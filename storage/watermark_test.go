@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/PlakarKorp/kloset/connectors/storage"
+	"github.com/PlakarKorp/kloset/objects"
+)
+
+// seqServer lists packfiles in the order they were added, the watermark
+// being how many there are.  Watermarks under forgotten are gone.
+type seqServer struct {
+	mu        sync.Mutex
+	macs      []objects.MAC
+	forgotten int
+	sinces    []string
+}
+
+func (q *seqServer) add(macs ...objects.MAC) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.macs = append(q.macs, macs...)
+}
+
+func (q *seqServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	since := r.URL.Query().Get("since")
+	q.sinces = append(q.sinces, since)
+	from := 0
+	if since != "" {
+		from, _ = strconv.Atoi(since)
+		if from < q.forgotten {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+	}
+	w.Header().Set(watermarkHeader, strconv.Itoa(len(q.macs)))
+	json.NewEncoder(w).Encode(q.macs[from:])
+}
+
+func TestListSince(t *testing.T) {
+	ctx := context.Background()
+	q := &seqServer{}
+	q.add(objects.MAC{1}, objects.MAC{2})
+	s, _ := newTestStore(t, q, nil)
+
+	macs, mark, err := s.ListSince(ctx, storage.StorageResourcePackfile, "")
+	if err != nil || !slices.Equal(macs, []objects.MAC{{1}, {2}}) || mark != "2" {
+		t.Fatalf("full listing: %v, %q, %v", macs, mark, err)
+	}
+
+	q.add(objects.MAC{3})
+	macs, mark, err = s.ListSince(ctx, storage.StorageResourcePackfile, mark)
+	if err != nil || !slices.Equal(macs, []objects.MAC{{3}}) || mark != "3" {
+		t.Fatalf("listing since 2: %v, %q, %v, want packfile 3 alone", macs, mark, err)
+	}
+
+	macs, mark, err = s.ListSince(ctx, storage.StorageResourcePackfile, mark)
+	if err != nil || len(macs) != 0 || mark != "3" {
+		t.Fatalf("listing with nothing new: %v, %q, %v", macs, mark, err)
+	}
+}
+
+func TestListSinceGone(t *testing.T) {
+	q := &seqServer{forgotten: 2}
+	q.add(objects.MAC{1}, objects.MAC{2}, objects.MAC{3})
+	s, _ := newTestStore(t, q, nil)
+
+	macs, mark, err := s.ListSince(context.Background(), storage.StorageResourcePackfile, "1")
+	if err != nil || !slices.Equal(macs, []objects.MAC{{1}, {2}, {3}}) || mark != "3" {
+		t.Fatalf("listing since a forgotten watermark: %v, %q, %v, want everything", macs, mark, err)
+	}
+	if !slices.Equal(q.sinces, []string{"1", ""}) {
+		t.Errorf("asked since %q, want a full listing after the 410", q.sinces)
+	}
+}
+
+func TestListSinceUnsupported(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t, &memServer{}, nil)
+	for _, mac := range []objects.MAC{{1}, {2}} {
+		if _, err := s.Put(ctx, storage.StorageResourcePackfile, mac, bytes.NewReader([]byte("packfile"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	macs, mark, err := s.ListSince(ctx, storage.StorageResourcePackfile, "some watermark")
+	if err != nil || len(macs) != 2 || mark != "" {
+		t.Fatalf("server without watermarks: %v, %q, %v, want the full listing and no watermark", macs, mark, err)
+	}
+}